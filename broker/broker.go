@@ -7,7 +7,12 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/marcell7/MQ/protocol"
 )
@@ -19,30 +24,102 @@ type Server interface {
 
 // Implements the Server interface
 type Broker struct {
-	listenAddr  string                   // Address the broker is listening on
-	listener    net.Listener             // Listener object
-	mu          sync.RWMutex             // Mutex for adding and removing to and from publishers, subscribers and Topics maps
-	publishers  map[string]*Publisher    // Map that stores publishers registered on the broker - {"<publisher_id":"<Publisher>"}
-	subscribers map[string]*Subscriber   // Map that stores subscribers registered on the broker - {"<subscriber_id":"<Subscriber>"}
-	Topics      map[string]*DefaultTopic // Map that stores topics on the broker - {"<topic_id>":"<DefaultTopic>"}
-	protocol    protocol.Protocol        // Protocol object holding the methods required for decoding/encoding data sent to and from the broker
+	listenAddr    string                   // Address the broker is listening on
+	listener      net.Listener             // Listener object
+	mu            sync.RWMutex             // Mutex for adding and removing to and from publishers, subscribers and Topics maps
+	publishers    map[string]*Publisher    // Map that stores publishers registered on the broker - {"<publisher_id":"<Publisher>"}
+	subscribers   map[string]*Subscriber   // Map that stores subscribers registered on the broker - {"<subscriber_id":"<Subscriber>"}
+	Topics        map[string]*DefaultTopic // Map that stores topics on the broker - {"<topic_id>":"<DefaultTopic>"}
+	topics        *topicTrie               // Index of topics and wildcard subscriptions by the levels of their names
+	dataDir       string                   // Directory holding the topic logs. Topics are kept only in memory if empty
+	syncPolicy    SyncPolicy               // fsync policy of the topic logs
+	segmentSize   int64                    // Size after which a topic log segment is rolled over
+	ackTimeout    time.Duration            // Default time after which an unacknowledged item is redelivered
+	err           error                    // Error encountered while restoring topics from dataDir. Returned by Listen
+	redriveMu     sync.Mutex               // Mutex ensuring that items of a dead-letter topic are moved back only once
+	autoCreate    bool                     // Topics are created on first publish or subscribe instead of the request being rejected
+	inboxes       map[string]*inbox        // Reply inboxes of the connected clients - {"<inbox_name>":"<inbox>"}
+	durableExpiry time.Duration            // Time after which subscriptions of a durable subscriber that didn't reconnect are deleted. Never if zero
+	abandoned     map[string]time.Time     // Durable subscribers that are not connected and the time they disconnected - {"<subscriber_id>":"<time>"}
 
 	exitCh chan struct{} // Channel used for signaling when to exit the server. Used for manually stopping the server
 }
 
+// Option configures the Broker
+type Option func(*Broker)
+
+// Makes topics durable by keeping a write-ahead log for each of them in dir
+func WithDataDir(dir string) Option {
+	return func(b *Broker) {
+		b.dataDir = dir
+	}
+}
+
+// Sets how often the topic logs are fsync'ed. Defaults to SyncAlways
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(b *Broker) {
+		b.syncPolicy = policy
+	}
+}
+
+// Sets the size after which a topic log segment is rolled over
+func WithSegmentSize(size int64) Option {
+	return func(b *Broker) {
+		b.segmentSize = size
+	}
+}
+
+// Sets the default time after which items delivered to subscribers that acknowledge them are redelivered
+func WithAckTimeout(timeout time.Duration) Option {
+	return func(b *Broker) {
+		b.ackTimeout = timeout
+	}
+}
+
+// Creates topics that don't exist yet when they are first published or subscribed to
+func WithAutoCreateTopics() Option {
+	return func(b *Broker) {
+		b.autoCreate = true
+	}
+}
+
+// Sets the time after which subscriptions of a durable subscriber that didn't reconnect are deleted.
+// Subscriptions are kept forever if zero. Defaults to an hour
+func WithDurableExpiry(expiry time.Duration) Option {
+	return func(b *Broker) {
+		b.durableExpiry = expiry
+	}
+}
+
 // Constructor for the Broker struct
-func New(listenAddr string) *Broker {
-	return &Broker{
-		listenAddr:  listenAddr,
-		publishers:  make(map[string]*Publisher),
-		subscribers: make(map[string]*Subscriber),
-		protocol:    new(protocol.DefaultProtocol),
-		Topics:      make(map[string]*DefaultTopic),
-		exitCh:      make(chan struct{}),
+// If the broker is durable, topics found in the data directory are restored from their logs
+func New(listenAddr string, opts ...Option) *Broker {
+	b := &Broker{
+		listenAddr:    listenAddr,
+		publishers:    make(map[string]*Publisher),
+		subscribers:   make(map[string]*Subscriber),
+		Topics:        make(map[string]*DefaultTopic),
+		topics:        newTopicTrie(),
+		inboxes:       make(map[string]*inbox),
+		durableExpiry: defaultDurableExpiry,
+		abandoned:     make(map[string]time.Time),
+		segmentSize:   defaultSegmentSize,
+		ackTimeout:    defaultAckTimeout,
+		exitCh:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.dataDir != "" {
+		b.err = b.restore()
 	}
+	return b
 }
 
 func (b *Broker) Listen() error {
+	if b.err != nil {
+		return b.err
+	}
 	listener, err := net.Listen("tcp", b.listenAddr)
 	if err != nil {
 		return err
@@ -56,14 +133,437 @@ func (b *Broker) Listen() error {
 func (b *Broker) Stop() {
 	log.Println("Stopping the broker...")
 	close(b.exitCh)
-	b.listener.Close()
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	b.mu.RLock()
+	for _, topic := range b.Topics {
+		if topic.log != nil {
+			if err := topic.log.close(); err != nil {
+				log.Printf("Error closing the log of topic %s: %s", topic.name, err)
+			}
+		}
+	}
+	b.mu.RUnlock()
+}
+
+// Adds a topic to the broker. Adding a topic that already exists (e.g. restored from its log) only applies the options
+// on top of its current config. Levels of hierarchical topic names are separated with protocol.TopicSeparator.
+// New topic is subscribed to by every wildcard subscription it matches
+func (b *Broker) AddTopic(name string, opts ...TopicOption) error {
+	return b.declareTopic(name, false, opts)
+}
+
+// Adds the topic or applies the options to the existing one. Fails if the topic already exists and exclusive is set
+func (b *Broker) declareTopic(name string, exclusive bool, opts []TopicOption) error {
+	if err := protocol.ValidateTopic(name, false); err != nil {
+		return err
+	}
+	if protocol.IsInbox(name) {
+		return fmt.Errorf("topic name %s starts with %s which is reserved for inboxes", name, protocol.InboxPrefix)
+	}
+	topic, wildcards, err := b.addTopic(name, exclusive, opts)
+	if err != nil {
+		return err
+	}
+	for _, ws := range wildcards {
+		topic.addSubscription(ws.subscriber.id, ws.subscriber, ws.opts)
+	}
+	return nil
+}
 
+// Creates the topic if it doesn't exist and applies the options to its config.
+// Returns the topic together with the wildcard subscriptions it has to be subscribed to if it was created
+func (b *Broker) addTopic(name string, exclusive bool, opts []TopicOption) (*DefaultTopic, []*wildcardSubscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	config := TopicConfig{}
+	if existing, ok := b.Topics[name]; ok {
+		if exclusive {
+			return nil, nil, fmt.Errorf("topic %s already exists", name)
+		}
+		config = existing.config
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := b.validateTopicConfig(name, config); err != nil {
+		return nil, nil, err
+	}
+	topic, wildcards, err := b.createTopic(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Dead-letter topic is resolved up front, so that moving items into it never goes back to the broker
+	// while the topic is locked. Locks are always taken in the order broker, topic, dead-letter topic
+	var dlq *DefaultTopic
+	if config.DeadLetterTopic != "" {
+		var dlqWildcards []*wildcardSubscription
+		if dlq, dlqWildcards, err = b.createTopic(config.DeadLetterTopic); err != nil {
+			return nil, nil, err
+		}
+		for _, ws := range dlqWildcards {
+			// Topics never take the broker's lock, so the dead-letter topic can be subscribed to while holding it
+			dlq.addSubscription(ws.subscriber.id, ws.subscriber, ws.opts)
+		}
+	}
+	// Config is changed only with the broker's lock held, so validateTopicConfig can read it without the topic's lock
+	topic.mu.Lock()
+	defer topic.mu.Unlock()
+	if config != topic.config {
+		if err := topic.persist(&logRecord{Type: recordConfig, Config: &config}); err != nil {
+			return nil, nil, err
+		}
+	}
+	topic.config = config
+	topic.deadLetter = dlq
+	topic.trim(time.Now())
+	return topic, wildcards, nil
 }
 
-func (b *Broker) AddTopic(name string) {
-	id := generateId()
-	topic := newDefaultTopic(id, name)
+// Returns the topic creating it if it doesn't exist. Has to be called with b.mu held.
+// Returns the wildcard subscriptions the topic has to be subscribed to if it was created
+func (b *Broker) createTopic(name string) (*DefaultTopic, []*wildcardSubscription, error) {
+	if topic, ok := b.Topics[name]; ok {
+		return topic, nil, nil
+	}
+	topic, err := b.openTopic(name)
+	if err != nil {
+		return nil, nil, err
+	}
 	b.Topics[name] = topic
+	b.topics.addTopic(topic)
+	return topic, b.topics.matchWildcards(name), nil
+}
+
+// Deletes the topic together with its items, subscriptions and log.
+// Dead-letter topic can't be deleted while a topic still moves its items into it
+func (b *Broker) DeleteTopic(name string) error {
+	b.mu.Lock()
+	topic, ok := b.Topics[name]
+	if ok {
+		for _, other := range b.Topics {
+			if other.config.DeadLetterTopic == name {
+				b.mu.Unlock()
+				return fmt.Errorf("topic %s is the dead-letter topic of %s", name, other.name)
+			}
+		}
+		delete(b.Topics, name)
+		b.topics.removeTopic(name)
+	}
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("topic %s does not exist", name)
+	}
+	topic.close()
+	if topic.log != nil {
+		return topic.log.remove()
+	}
+	return nil
+}
+
+// Returns the state of every topic ordered by name
+func (b *Broker) ListTopics() []TopicInfo {
+	b.mu.RLock()
+	topics := make([]*DefaultTopic, 0, len(b.Topics))
+	for _, topic := range b.Topics {
+		topics = append(topics, topic)
+	}
+	b.mu.RUnlock()
+	infos := make([]TopicInfo, 0, len(topics))
+	for _, topic := range topics {
+		infos = append(infos, topic.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Returns the state of the topic
+func (b *Broker) TopicInfo(name string) (TopicInfo, error) {
+	topic, err := b.topic(name, false)
+	if err != nil {
+		return TopicInfo{}, err
+	}
+	return topic.info(), nil
+}
+
+// Returns the topic with the given name. Missing topic is created if create is set and the broker auto-creates topics
+func (b *Broker) topic(name string, create bool) (*DefaultTopic, error) {
+	if protocol.IsPattern(name) {
+		return nil, fmt.Errorf("%s is a pattern and not a topic", name)
+	}
+	b.mu.RLock()
+	topic, ok := b.Topics[name]
+	b.mu.RUnlock()
+	if ok {
+		return topic, nil
+	}
+	if !create || !b.autoCreate {
+		return nil, fmt.Errorf("topic %s does not exist", name)
+	}
+	if err := b.AddTopic(name); err != nil {
+		return nil, err
+	}
+	return b.topic(name, false)
+}
+
+// Returns every topic matching the pattern
+func (b *Broker) matchTopics(pattern string) []*DefaultTopic {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.topics.matchTopics(pattern)
+}
+
+// Subscribes the subscriber to the topic. If the topic is a pattern, the subscriber is subscribed to every
+// matching topic, including the ones created later. Reports whether a new subscription was created in any of the topics
+func (b *Broker) subscribe(subscriber *Subscriber, name string, opts subscriptionOptions) (bool, error) {
+	if !protocol.IsPattern(name) {
+		topic, err := b.topic(name, true)
+		if err != nil {
+			return false, err
+		}
+		return topic.addSubscription(subscriber.id, subscriber, opts), nil
+	}
+	if err := protocol.ValidateTopic(name, true); err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	b.topics.addWildcard(&wildcardSubscription{pattern: name, subscriber: subscriber, opts: opts})
+	topics := b.topics.matchTopics(name)
+	b.mu.Unlock()
+	created := false
+	for _, topic := range topics {
+		if topic.addSubscription(subscriber.id, subscriber, opts) {
+			created = true
+		}
+	}
+	return created, nil
+}
+
+// Unsubscribes the subscriber from the topic. If the topic is a pattern, the wildcard subscription is removed
+// and the subscriber is unsubscribed from every matching topic
+func (b *Broker) unsubscribe(subscriber *Subscriber, name string, drain bool) error {
+	if !protocol.IsPattern(name) {
+		topic, err := b.topic(name, false)
+		if err != nil {
+			return err
+		}
+		return topic.unsubscribe(subscriber.id, drain)
+	}
+	b.mu.Lock()
+	found := b.topics.removeWildcard(name, subscriber.id)
+	topics := b.topics.matchTopics(name)
+	b.mu.Unlock()
+	if !found {
+		return errors.New("not subscribed to this pattern")
+	}
+	for _, topic := range topics {
+		if err := topic.unsubscribe(subscriber.id, drain); err != nil && err != errNotSubscribed && err != errTopicDeleted {
+			return err
+		}
+	}
+	return nil
+}
+
+// Takes the next item out of the subscriber's queue in the topic, or in any of the topics matching the pattern.
+// With wait set, parks until an item arrives or the wait times out. Returns errEmptyQueue if there is no item
+// and errCancelled if cancel is closed while waiting
+func (b *Broker) receive(id string, name string, wait time.Duration, cancel <-chan struct{}) (*DefaultTopic, *Item, error) {
+	if !protocol.IsPattern(name) {
+		topic, err := b.topic(name, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		var item *Item
+		if wait > 0 {
+			item, err = topic.waitItem(id, wait, cancel)
+		} else {
+			item, err = topic.popItem(id)
+		}
+		return topic, item, err
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-cancel:
+			return nil, nil, errCancelled
+		default:
+		}
+		var changed []<-chan struct{}
+		for _, topic := range b.matchTopics(name) {
+			item, ch, err := topic.popOrWatch(id)
+			switch err {
+			case nil:
+				return topic, item, nil
+			case errEmptyQueue:
+				changed = append(changed, ch)
+			case errNotSubscribed, errTopicDeleted:
+				// Subscriber is not subscribed to every matching topic
+			default:
+				return nil, nil, err
+			}
+		}
+		if len(changed) == 0 {
+			return nil, nil, errors.New("not subscribed to any topic matching the pattern")
+		}
+		if wait <= 0 || !waitAny(append(changed, cancel), timer.C) {
+			return nil, nil, errEmptyQueue
+		}
+	}
+}
+
+// Moves the subscriber's cursor in the topic, or in every topic matching the pattern it is subscribed to
+func (b *Broker) seek(id string, name string, offset int64) error {
+	if !protocol.IsPattern(name) {
+		topic, err := b.topic(name, false)
+		if err != nil {
+			return err
+		}
+		_, err = topic.seek(id, offset)
+		return err
+	}
+	for _, topic := range b.matchTopics(name) {
+		if _, err := topic.seek(id, offset); err != nil && err != errNotSubscribed && err != errTopicDeleted {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dead-letter topics can't have dead-letter topics of their own. This keeps items from cycling between topics.
+// Has to be called with b.mu held. Config of a topic only changes with b.mu held, so it can be read without the topic's lock
+func (b *Broker) validateTopicConfig(name string, config TopicConfig) error {
+	if config.MaxDeliveries < 0 || config.MaxItems < 0 || config.MaxBytes < 0 || config.TTL < 0 || config.DedupWindow < 0 ||
+		config.RetentionItems < 0 || config.RetentionAge < 0 {
+		return errors.New("topic limits must not be negative")
+	}
+	if config.Overflow < OverflowReject || config.Overflow > OverflowDropNewest {
+		return fmt.Errorf("unknown overflow policy %s", config.Overflow)
+	}
+	if config.DeadLetterTopic == "" {
+		return nil
+	}
+	if config.DeadLetterTopic == name {
+		return errors.New("topic can't be its own dead-letter topic")
+	}
+	if dlq, ok := b.Topics[config.DeadLetterTopic]; ok && dlq.config.DeadLetterTopic != "" {
+		return fmt.Errorf("topic %s has a dead-letter topic and can't be used as one", config.DeadLetterTopic)
+	}
+	for _, topic := range b.Topics {
+		if topic.config.DeadLetterTopic == name {
+			return fmt.Errorf("topic %s is a dead-letter topic and can't have one", name)
+		}
+	}
+	return nil
+}
+
+// Moves up to max items (all if max <= 0) from the dead-letter topic back to the topics they were originally published to.
+// Returns the number of items moved
+func (b *Broker) Redrive(name string, max int) (int, error) {
+	b.redriveMu.Lock()
+	defer b.redriveMu.Unlock()
+	b.mu.RLock()
+	dlq, ok := b.Topics[name]
+	b.mu.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("topic %s does not exist", name)
+	}
+	items := dlq.redriveItems(max)
+	moved := 0
+	var err error
+	for _, item := range items {
+		if item.DeadLetter != nil {
+			b.mu.RLock()
+			original, ok := b.Topics[item.DeadLetter.Topic]
+			b.mu.RUnlock()
+			if !ok {
+				err = fmt.Errorf("topic %s does not exist", item.DeadLetter.Topic)
+				break
+			}
+			redriven := item.clone()
+			redriven.Priority = item.DeadLetter.Priority
+			if err = original.store(redriven); err != nil {
+				break
+			}
+		}
+		moved++
+	}
+	if moved > 0 {
+		if advanceErr := dlq.advanceRedrive(items[moved-1].Offset + 1); advanceErr != nil && err == nil {
+			err = advanceErr
+		}
+	}
+	return moved, err
+}
+
+// Creates a topic and, if the broker is durable, opens its log replaying everything stored in it
+func (b *Broker) openTopic(name string) (*DefaultTopic, error) {
+	topic := newDefaultTopic(generateId(), name)
+	if b.dataDir == "" {
+		return topic, nil
+	}
+	if name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid topic name %q", name)
+	}
+	dir := filepath.Join(b.dataDir, url.PathEscape(name))
+	topicLog, err := openTopicLog(dir, b.syncPolicy, b.segmentSize, topic.replay)
+	if err != nil {
+		return nil, err
+	}
+	topic.log = topicLog
+	// Items scheduled before the restart are delivered once they are due
+	topic.mu.Lock()
+	topic.snapshot = nil
+	topic.armTimer()
+	topic.mu.Unlock()
+	return topic, nil
+}
+
+// Restores every topic that has a log in the data directory
+func (b *Broker) restore() error {
+	if err := os.MkdirAll(b.dataDir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(b.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		topic, err := b.openTopic(name)
+		if err != nil {
+			return fmt.Errorf("restoring topic %s: %w", name, err)
+		}
+		b.Topics[name] = topic
+		b.topics.addTopic(topic)
+		// Durable subscribers have to reconnect before their subscriptions expire
+		for id := range topic.Subscriptions {
+			if _, ok := b.abandoned[id]; !ok && isDurable(id) {
+				b.abandon(id)
+			}
+		}
+	}
+	// Dead-letter topics are resolved once every topic is restored, so they aren't created empty before their log is read
+	for _, topic := range b.Topics {
+		if topic.config.DeadLetterTopic == "" {
+			continue
+		}
+		dlq, _, err := b.createTopic(topic.config.DeadLetterTopic)
+		if err != nil {
+			return fmt.Errorf("restoring dead-letter topic of topic %s: %w", topic.name, err)
+		}
+		topic.deadLetter = dlq
+	}
+	return nil
 }
 
 func (b *Broker) startAcceptingConnections() error {
@@ -86,21 +586,42 @@ func (b *Broker) startAcceptingConnections() error {
 func (b *Broker) handleConnection(conn net.Conn) error {
 	var publisher *Publisher
 	var subscriber *Subscriber
+	clientId := generateId()
+	// Closed when the connection drops. Cancels the receives still waiting for an item
+	closed := make(chan struct{})
+	// Closed once the long poll of a client that doesn't send request ids finishes. Its next request waits for the reply
+	var parked chan struct{}
 	defer func() {
+		close(closed)
+		b.removeInboxes(clientId)
 		if publisher != nil {
 			b.removeClient(publisher)
 		}
 		if subscriber != nil {
-			b.removeAllClientSubscriptions(subscriber)
-			b.removeClient(subscriber)
+			subscriber.close()
+			if isDurable(subscriber.id) {
+				// Subscriptions of a durable subscriber wait for it to reconnect
+				b.detachDurable(subscriber)
+			} else {
+				b.removeAllClientSubscriptions(subscriber)
+				b.removeClient(subscriber)
+			}
 		}
 		fmt.Println("Dropping a connection with client")
 		conn.Close()
 	}()
-	clientId := generateId()
 	reader := bufio.NewReader(conn)
+	// Protocol is picked by the client. Every message on the connection is decoded and encoded with it
+	proto, err := protocol.Negotiate(reader)
+	if err != nil {
+		if err != io.EOF {
+			fmt.Printf("error: %s\n", err)
+		}
+		return err
+	}
+	client := newConnection(conn, proto)
 	for {
-		data, _, err := reader.ReadLine()
+		data, err := proto.ReadFrame(reader)
 		if err != nil {
 			if err == io.EOF {
 				// No data in the reader
@@ -112,55 +633,296 @@ func (b *Broker) handleConnection(conn net.Conn) error {
 
 		}
 		msg := &protocol.DefaultMessage{}
-		if err := b.protocol.Decode(msg, data); err != nil {
+		if err := proto.Decode(msg, data); err != nil {
 			return err
 		}
 
+		if parked != nil {
+			<-parked
+			parked = nil
+		}
+		// Replies echo the id of the request so that the client can match them to the requests in flight
+		reply := client.reply(msg.Payload.Request)
 		switch msg.Command {
-		case protocol.CMD_PUBREG:
-			publisher = newPublisher(clientId, conn)
-			b.addClient(publisher)
-			publisher.sendOk()
-		case protocol.CMD_SUBREG:
-			subscriber = newSubscriber(clientId, conn)
-			b.addClient(subscriber)
-			subscriber.sendOk()
+		case protocol.CMD_PUBREG, protocol.CMD_SUBREG, protocol.CMD_REG:
+			// REG registers the connection both as a publisher and as a subscriber
+			if msg.Command != protocol.CMD_PUBREG && subscriber == nil {
+				if msg.Payload.Name != "" {
+					// Subscriber registered with a durable name keeps its id, and with it its subscriptions, across connections
+					clientId = durableSubscriberId(msg.Payload.Name)
+					subscriber = newSubscriber(clientId, client)
+					b.attachDurable(subscriber)
+				} else {
+					subscriber = newSubscriber(clientId, client)
+					b.addClient(subscriber)
+				}
+			}
+			if msg.Command != protocol.CMD_SUBREG && publisher == nil {
+				publisher = newPublisher(clientId, client)
+				b.addClient(publisher)
+			}
+			if err := reply.sendOk(); err != nil {
+				return err
+			}
 		case protocol.CMD_PUB:
-			if _, ok := b.publishers[clientId]; ok {
-				item := newItem(msg.Id, msg.Payload.Message)
-				if err := b.Topics[msg.Payload.Topic].addItem(item); err != nil {
-					publisher.sendError("no active subscriptions")
+			if publisher != nil {
+				item := publishedItem(msg.Payload)
+				stored, err := b.publish(msg.Payload.Topic, item)
+				if err != nil {
+					reply.sendError(err.Error())
+					continue
 				}
-				err = publisher.sendOk()
+				err = reply.sendPublished(msg.Payload.Topic, stored, stored != item)
 				if err != nil {
 					return err
 				}
 			} else {
-				publisher.sendError("must be registered as a publisher")
+				reply.sendError("must be registered as a publisher")
 				return errors.New("must be registered as a publisher")
 			}
+		case protocol.CMD_REPLY:
+			// Responders are usually subscribers, so replies are accepted from subscribers as well
+			if publisher == nil && subscriber == nil {
+				reply.sendError("must be registered as a publisher or a subscriber")
+				return errors.New("must be registered as a publisher or a subscriber")
+			}
+			item := publishedItem(msg.Payload)
+			stored, err := b.publish(msg.Payload.Topic, item)
+			if err != nil {
+				reply.sendError(err.Error())
+				continue
+			}
+			if err := reply.sendPublished(msg.Payload.Topic, stored, stored != item); err != nil {
+				return err
+			}
+		case protocol.CMD_INBOX:
+			if publisher == nil && subscriber == nil {
+				reply.sendError("must be registered as a publisher or a subscriber")
+				return errors.New("must be registered as a publisher or a subscriber")
+			}
+			if err := reply.send(protocol.CMD_OK, &protocol.DefaultPayload{Topic: b.createInbox(clientId, client, time.Duration(msg.Payload.Wait)*time.Millisecond)}); err != nil {
+				return err
+			}
+		case protocol.CMD_REDRIVE:
+			if publisher == nil {
+				reply.sendError("must be registered as a publisher")
+				return errors.New("must be registered as a publisher")
+			}
+			if _, err := b.Redrive(msg.Payload.Topic, msg.Payload.Limit); err != nil {
+				reply.sendError(err.Error())
+				continue
+			}
+			if err := reply.sendOk(); err != nil {
+				return err
+			}
 		case protocol.CMD_SUB:
-			if subscriber, ok := b.subscribers[clientId]; ok {
-				b.Topics[msg.Payload.Topic].addSubscription(clientId, subscriber)
-				err = subscriber.sendOk()
+			if subscriber != nil {
+				opts := subscriptionOptions{
+					group:      msg.Payload.Group,
+					ack:        msg.Payload.Ack,
+					ackTimeout: b.ackTimeout,
+					stream:     msg.Payload.Stream,
+					prefetch:   msg.Payload.Prefetch,
+				}
+				if msg.Payload.AckTimeout > 0 {
+					opts.ackTimeout = time.Duration(msg.Payload.AckTimeout) * time.Millisecond
+				}
+				created, err := b.subscribe(subscriber, msg.Payload.Topic, opts)
+				if err != nil {
+					reply.sendError(err.Error())
+					continue
+				}
+				err = reply.send(protocol.CMD_OK, &protocol.DefaultPayload{Topic: msg.Payload.Topic, Created: created})
 				if err != nil {
 					return err
 				}
 			} else {
-				subscriber.sendError("must be registered as a subscriber")
+				reply.sendError("must be registered as a subscriber")
+				return errors.New("must be registered as a subscriber")
+			}
+		case protocol.CMD_UNSUB:
+			if subscriber == nil {
+				reply.sendError("must be registered as a subscriber")
 				return errors.New("must be registered as a subscriber")
 			}
+			if err := b.unsubscribe(subscriber, msg.Payload.Topic, msg.Payload.Drain); err != nil {
+				reply.sendError(err.Error())
+				continue
+			}
+			if err := reply.sendOk(); err != nil {
+				return err
+			}
 		case protocol.CMD_RECV:
-			if subscription, ok := b.Topics[msg.Payload.Topic].Subscriptions[clientId]; ok {
-				currentItem, err := subscription.popOut()
-				if err != nil {
-					subscriber.sendError("no items in the queue")
-					return err
+			if subscriber == nil {
+				reply.sendError("must be registered as a subscriber")
+				return errors.New("must be registered as a subscriber")
+			}
+			// With wait set this is a long poll - the request is parked until an item arrives or the wait times out
+			wait := time.Duration(msg.Payload.Wait) * time.Millisecond
+			if wait > 0 {
+				// Waiting happens off the read loop, so the loop notices when the connection drops and cancels the wait.
+				// Client matching replies by request id is served in the meantime
+				finished := make(chan struct{})
+				if msg.Payload.Request == "" {
+					parked = finished
 				}
-				subscriber.sendResp(currentItem)
+				go func(id string) {
+					defer close(finished)
+					b.handleReceive(reply, id, msg.Payload.Topic, wait, closed)
+				}(clientId)
+				continue
+			}
+			if err := b.handleReceive(reply, clientId, msg.Payload.Topic, wait, closed); err != nil {
+				return err
+			}
+		case protocol.CMD_SEEK:
+			if subscriber == nil {
+				reply.sendError("must be registered as a subscriber")
+				return errors.New("must be registered as a subscriber")
+			}
+			offset := msg.Payload.Offset
+			switch msg.Payload.Position {
+			case protocol.PositionEarliest:
+				offset = OffsetEarliest
+			case protocol.PositionLatest:
+				offset = OffsetLatest
+			}
+			if offset < 0 && msg.Payload.Position == "" {
+				reply.sendError("offset must not be negative")
+				continue
+			}
+			if err := b.seek(clientId, msg.Payload.Topic, offset); err != nil {
+				reply.sendError(err.Error())
+				continue
+			}
+			if err := reply.sendOk(); err != nil {
+				return err
+			}
+		case protocol.CMD_CREDIT:
+			// Credits are granted without waiting for a reply
+			if subscriber == nil {
+				reply.sendError("must be registered as a subscriber")
+				return errors.New("must be registered as a subscriber")
+			}
+			if topic, err := b.topic(msg.Payload.Topic, false); err == nil && msg.Payload.Credits > 0 {
+				topic.credit(clientId, msg.Payload.Credits)
+			}
+		case protocol.CMD_ACK, protocol.CMD_NACK:
+			if subscriber == nil {
+				reply.sendError("must be registered as a subscriber")
+				return errors.New("must be registered as a subscriber")
+			}
+			topic, err := b.topic(msg.Payload.Topic, false)
+			if err != nil {
+				reply.sendError(err.Error())
+				continue
+			}
+			if msg.Command == protocol.CMD_ACK {
+				err = topic.ack(clientId, msg.Payload.Offset)
+			} else {
+				err = topic.nack(clientId, msg.Payload.Offset, msg.Payload.Reason)
+			}
+			if err != nil {
+				reply.sendError(err.Error())
+				continue
+			}
+			if err := reply.sendOk(); err != nil {
+				return err
+			}
+		case protocol.CMD_TOPIC_CREATE, protocol.CMD_TOPIC_DELETE, protocol.CMD_TOPIC_LIST, protocol.CMD_TOPIC_INFO:
+			// Topics can be managed by any client, registered or not
+			if err := b.manageTopics(reply, msg); err != nil {
+				return err
+			}
+		default:
+			// Replies and other commands only the broker sends
+			if err := reply.sendError("unsupported command"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Replies to RECV with the next item of the subscriber. Only errors writing to the connection are returned
+func (b *Broker) handleReceive(reply *connection, id string, name string, wait time.Duration, cancel <-chan struct{}) error {
+	topic, item, err := b.receive(id, name, wait, cancel)
+	if err == errCancelled {
+		// Nobody is left to reply to
+		return nil
+	}
+	if err == errEmptyQueue && wait > 0 {
+		return reply.sendEmpty(name)
+	}
+	if err != nil {
+		return reply.sendError(err.Error())
+	}
+	return reply.sendResp(topic.name, item)
+}
+
+// Builds the item published with PUB or REPLY
+func publishedItem(payload *protocol.DefaultPayload) *Item {
+	item := newItem("", payload.Message)
+	item.Headers = payload.Headers
+	item.DedupKey = payload.DedupKey
+	item.ReplyTo = payload.ReplyTo
+	item.Priority = payload.Priority
+	item.Retain = payload.Retain
+	now := time.Now()
+	switch {
+	case payload.DeliverAt > 0:
+		item.DeliverAt = payload.DeliverAt
+	case payload.Delay > 0:
+		item.DeliverAt = now.Add(time.Duration(payload.Delay) * time.Millisecond).UnixMilli()
+	}
+	if payload.TTL > 0 {
+		item.Expires = item.visibleFrom(now).Add(time.Duration(payload.TTL) * time.Millisecond).UnixMilli()
+	}
+	return item
+}
+
+// Publishes the item to the topic, or delivers it to the requester if the name is the name of a reply inbox.
+// Returns the item published earlier instead if the item is a duplicate
+func (b *Broker) publish(name string, item *Item) (*Item, error) {
+	if protocol.IsInbox(name) {
+		return item, b.deliverReply(name, item)
+	}
+	topic, err := b.topic(name, true)
+	if err != nil {
+		return nil, err
+	}
+	// Empty retained item clears the retained item of the topic instead of being published
+	if item.Retain && item.Data == "" {
+		return item, topic.clearRetained()
+	}
+	return topic.addItem(item)
+}
+
+// Handles the topic management commands. Only errors writing to the connection are returned
+func (b *Broker) manageTopics(client *connection, msg *protocol.DefaultMessage) error {
+	var err error
+	switch msg.Command {
+	case protocol.CMD_TOPIC_CREATE:
+		config := TopicConfig{}
+		if msg.Payload.Config != nil {
+			if config, err = topicConfigFromWire(msg.Payload.Config); err != nil {
+				break
 			}
 		}
+		err = b.declareTopic(msg.Payload.Topic, true, []TopicOption{WithTopicConfig(config)})
+	case protocol.CMD_TOPIC_DELETE:
+		err = b.DeleteTopic(msg.Payload.Topic)
+	case protocol.CMD_TOPIC_LIST:
+		return client.sendTopics(b.ListTopics())
+	case protocol.CMD_TOPIC_INFO:
+		var info TopicInfo
+		if info, err = b.TopicInfo(msg.Payload.Topic); err == nil {
+			return client.sendTopics([]TopicInfo{info})
+		}
+	}
+	if err != nil {
+		return client.sendError(err.Error())
 	}
+	return client.sendOk()
 }
 
 func (b *Broker) addClient(client Client) {
@@ -178,16 +940,27 @@ func (b *Broker) removeClient(client Client) {
 	b.mu.Lock()
 	switch c := client.(type) {
 	case *Publisher:
-		delete(b.publishers, c.id)
+		if b.publishers[c.id] == c {
+			delete(b.publishers, c.id)
+		}
 	case *Subscriber:
-		delete(b.subscribers, c.id)
+		if b.subscribers[c.id] == c {
+			delete(b.subscribers, c.id)
+		}
 
 	}
 	b.mu.Unlock()
 }
 
 func (b *Broker) removeAllClientSubscriptions(subscriber *Subscriber) {
+	b.mu.Lock()
+	b.topics.removeSubscriber(subscriber.id)
+	topics := make([]*DefaultTopic, 0, len(b.Topics))
 	for _, topic := range b.Topics {
+		topics = append(topics, topic)
+	}
+	b.mu.Unlock()
+	for _, topic := range topics {
 		topic.deleteSubscription(subscriber.id)
 	}
 }
@@ -1,11 +1,16 @@
 package broker
 
 import (
+	"bufio"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/marcell7/MQ/client"
+	"github.com/marcell7/MQ/protocol"
 )
 
 func TestDeleteSubscriptionOnSubscriberDisconnect(t *testing.T) {
@@ -42,8 +47,1263 @@ func TestDeleteSubscriptionOnSubscriberDisconnect(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	subscriber.Close()
+	time.Sleep(1 * time.Second)
 
 	if len(b.Topics["default"].Subscriptions) != 0 {
 		t.Errorf("Expected 0 subscriptions got %d", len(b.Topics["default"].Subscriptions))
 	}
 }
+
+func TestRestoreTopicsFromLog(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3100", WithDataDir(dir))
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3100", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	transient, err := client.NewSubscriber("127.0.0.1:3100")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer transient.Close()
+	if err = transient.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3100")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, payload := range []string{
+		`{"topic":"default","message":"first"}`,
+		`{"topic":"default","message":"second"}`,
+		`{"topic":"default","message":"third"}`,
+	} {
+		if err = publisher.Publish(payload); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if _, err = subscriber.Receive("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	b.Stop()
+
+	restored := New("127.0.0.1:3100", WithDataDir(dir))
+	defer restored.Stop()
+	topic, ok := restored.Topics["default"]
+	if !ok {
+		t.Fatalf("Expected topic default to be restored")
+	}
+	if topic.latestOffset() != 3 {
+		t.Errorf("Expected 3 items in the restored topic got %d", topic.latestOffset())
+	}
+	// Subscriber that isn't durable can't come back for its subscription
+	if len(topic.Subscriptions) != 1 {
+		t.Fatalf("Expected 1 restored subscription got %d", len(topic.Subscriptions))
+	}
+	for _, subscription := range topic.Subscriptions {
+		if len(subscription.Queue) != 2 {
+			t.Fatalf("Expected 2 items in the restored queue got %d", len(subscription.Queue))
+		}
+		if subscription.Queue[0].Offset != 1 || subscription.Queue[0].Data != "second" {
+			t.Errorf("Expected the restored queue to start at offset 1 (second) got %d (%s)", subscription.Queue[0].Offset, subscription.Queue[0].Data)
+		}
+		if subscription.subscriber != nil {
+			t.Errorf("Expected restored subscription to be detached")
+		}
+	}
+}
+
+func TestRestoreTopicConfig(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3118", WithDataDir(dir))
+	if err := b.AddTopic("orders", WithMaxDeliveries(2), WithDeadLetterTopic("orders.dlq"), WithRetentionItems(5)); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	b.Stop()
+
+	expected := TopicConfig{MaxDeliveries: 2, DeadLetterTopic: "orders.dlq", RetentionItems: 5}
+	// Config is read from the record written when it was set and then from the snapshot of the compacted log
+	for i := 0; i < 2; i++ {
+		restored := New("127.0.0.1:3118", WithDataDir(dir))
+		topic, ok := restored.Topics["orders"]
+		if !ok {
+			restored.Stop()
+			t.Fatalf("Expected topic orders to be restored")
+		}
+		if topic.config != expected {
+			t.Errorf("Expected restored config %+v got %+v", expected, topic.config)
+		}
+		if topic.deadLetter == nil || topic.deadLetter != restored.Topics["orders.dlq"] {
+			t.Errorf("Expected dead-letter topic orders.dlq to be resolved")
+		}
+		topic.compact()
+		restored.Stop()
+	}
+}
+
+func TestTopicLogTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	topicLog, err := openTopicLog(dir, SyncPolicy{Mode: SyncBatch, BatchSize: 10}, 0, func(*logRecord) error { return nil })
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, data := range []string{"first", "second"} {
+		if err := topicLog.append(&logRecord{Type: recordItem, Item: newItem("", data)}); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	topicLog.close()
+
+	// Simulate a crash in the middle of writing a record
+	segment, err := os.OpenFile(topicLog.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	segment.Write([]byte{0, 0, 0, 42, 1, 2})
+	segment.Close()
+
+	var replayed []string
+	topicLog, err = openTopicLog(dir, SyncPolicy{Mode: SyncAlways}, 0, func(rec *logRecord) error {
+		replayed = append(replayed, rec.Item.Data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer topicLog.close()
+	if len(replayed) != 2 || replayed[0] != "first" || replayed[1] != "second" {
+		t.Errorf("Expected to replay [first second] got %v", replayed)
+	}
+	if err := topicLog.append(&logRecord{Type: recordItem, Item: newItem("", "third")}); err != nil {
+		t.Errorf("Error appending after truncation: %s", err)
+	}
+}
+
+func TestTopicLogCompaction(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3117", WithDataDir(dir), WithSegmentSize(1024))
+	b.AddTopic("default", WithRetentionItems(5))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3117", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3117")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"item%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	// Leaves items 40-49 queued, half of them already out of the retention
+	for i := 0; i < 40; i++ {
+		if _, err = subscriber.Receive("default"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// Compaction runs in the background and deletes the first segment
+	first := filepath.Join(dir, "default", fmt.Sprintf("%020d%s", 0, segmentExt))
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(first); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the first segment to be compacted away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Stop()
+
+	restored := New("127.0.0.1:3117", WithDataDir(dir))
+	defer restored.Stop()
+	topic, ok := restored.Topics["default"]
+	if !ok {
+		t.Fatalf("Expected topic default to be restored")
+	}
+	if topic.base == 0 || topic.latestOffset() != 50 || topic.sequence != 50 {
+		t.Errorf("Expected the restored topic to keep the last items up to offset 50 got base %d, next offset %d, sequence %d",
+			topic.base, topic.latestOffset(), topic.sequence)
+	}
+	if len(topic.Subscriptions) != 1 {
+		t.Fatalf("Expected 1 restored subscription got %d", len(topic.Subscriptions))
+	}
+	for _, subscription := range topic.Subscriptions {
+		if len(subscription.Queue) != 10 {
+			t.Fatalf("Expected 10 items in the restored queue got %d", len(subscription.Queue))
+		}
+		for i, item := range subscription.Queue {
+			if item.Offset != int64(40+i) || item.Data != fmt.Sprintf("item%d", 40+i) {
+				t.Errorf("Expected item%d at offset %d in the restored queue got %s at offset %d", 40+i, 40+i, item.Data, item.Offset)
+			}
+		}
+	}
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	b := New("127.0.0.1:3101")
+	if err := b.AddTopic("orders", WithMaxDeliveries(2), WithDeadLetterTopic("orders.dlq")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3101")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.SubscribeWith("orders", client.SubscribeOptions{Ack: true}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3101")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"orders","message":"poison","replyto":"orders.replies"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := subscriber.Receive("orders")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if err = subscriber.NackWithReason(msg, "invalid order"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// Item was given up on after the second delivery
+	if err = subscriber.Subscribe("orders.dlq"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.SeekToEarliest("orders.dlq"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("orders.dlq")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	deadLetter := msg.Payload.DeadLetter
+	if msg.Payload.Message != "poison" || deadLetter == nil {
+		t.Fatalf("Expected poison with dead-letter metadata got %s (%v)", msg.Payload.Message, deadLetter)
+	}
+	if deadLetter.Topic != "orders" || deadLetter.Offset != 0 || deadLetter.Attempts != 2 || deadLetter.Reason != "invalid order" {
+		t.Errorf("Expected dead letter from orders at offset 0 after 2 attempts (invalid order) got %+v", *deadLetter)
+	}
+	if msg.Payload.ReplyTo != "orders.replies" {
+		t.Errorf("Expected the dead letter to keep its reply-to got %q", msg.Payload.ReplyTo)
+	}
+
+	// Move it back for reprocessing
+	if err = publisher.Redrive("orders.dlq", 0); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err = subscriber.Receive("orders")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "poison" || msg.Payload.DeadLetter != nil || msg.Payload.ReplyTo != "orders.replies" {
+		t.Errorf("Expected redriven poison with its reply-to and without dead-letter metadata got %s (%q, %v)",
+			msg.Payload.Message, msg.Payload.ReplyTo, msg.Payload.DeadLetter)
+	}
+	if moved, err := b.Redrive("orders.dlq", 0); err != nil || moved != 0 {
+		t.Errorf("Expected nothing left to redrive got %d (%v)", moved, err)
+	}
+}
+
+func TestRedriveKeepsPriority(t *testing.T) {
+	b := New("127.0.0.1:3119")
+	if err := b.AddTopic("jobs", WithPriorities(), WithMaxDeliveries(1), WithDeadLetterTopic("jobs.dlq")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3119")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.SubscribeWith("jobs", client.SubscribeOptions{Ack: true}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3119")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err = publisher.PublishWith("jobs", []byte("urgent"), client.PublishOptions{Priority: 5}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("jobs")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Nack(msg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// Dead-letter topic ignores priorities, but the item gets its priority back when it's redriven
+	if moved, err := b.Redrive("jobs.dlq", 0); err != nil || moved != 1 {
+		t.Fatalf("Expected 1 item to be redriven got %d (%v)", moved, err)
+	}
+	if _, err = publisher.PublishWith("jobs", []byte("bulk"), client.PublishOptions{}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err = subscriber.Receive("jobs")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "urgent" || msg.Payload.Priority != 5 {
+		t.Errorf("Expected the redriven urgent item with priority 5 got %s (%d)", msg.Payload.Message, msg.Payload.Priority)
+	}
+}
+
+func TestDeadLetterTopicCycle(t *testing.T) {
+	b := New("127.0.0.1:3102")
+	if err := b.AddTopic("orders", WithDeadLetterTopic("orders.dlq")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := b.AddTopic("orders.dlq", WithDeadLetterTopic("orders")); err == nil {
+		t.Errorf("Expected error configuring a dead-letter topic with its own dead-letter topic got none")
+	}
+	if err := b.DeleteTopic("orders.dlq"); err == nil {
+		t.Errorf("Expected error deleting a dead-letter topic still in use got none")
+	}
+}
+
+func TestDeadLetterWhileReconfiguring(t *testing.T) {
+	b := New("127.0.0.1:3115")
+	opts := []TopicOption{WithMaxDeliveries(1), WithDeadLetterTopic("orders.dlq")}
+	b.AddTopic("orders", opts...)
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3115")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.SubscribeWith("orders", client.SubscribeOptions{Ack: true}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3115")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer publisher.Close()
+	if err = publisher.PublishMessage("orders", []byte("poison")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// Topic is reconfigured while one of its items is being moved to the dead-letter topic
+	topic := b.Topics["orders"]
+	topic.mu.Lock()
+	configured := make(chan struct{})
+	go func() {
+		defer close(configured)
+		b.AddTopic("orders", opts...)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	movedCh := make(chan struct{})
+	go func() {
+		defer close(movedCh)
+		for _, subscription := range topic.Subscriptions {
+			item, _ := subscription.popOut()
+			topic.giveUp(subscription, item)
+		}
+		topic.mu.Unlock()
+	}()
+	for _, ch := range []chan struct{}{movedCh, configured} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Dead-lettering and reconfiguring the topic deadlocked")
+		}
+	}
+	if info, err := b.TopicInfo("orders.dlq"); err != nil || info.NextOffset != 1 {
+		t.Errorf("Expected the item in the dead-letter topic got %+v (%v)", info, err)
+	}
+}
+
+func TestTopicManagement(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3103", WithDataDir(dir))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	publisher, err := client.NewPublisher("127.0.0.1:3103")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	subscriber, err := client.NewSubscriber("127.0.0.1:3103")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+
+	// Unknown topics are rejected without dropping the connection
+	if err = subscriber.Subscribe("orders"); err == nil {
+		t.Fatalf("Expected error subscribing to an unknown topic got none")
+	}
+	if err = publisher.Publish(`{"topic":"orders","message":"first"}`); err == nil {
+		t.Fatalf("Expected error publishing to an unknown topic got none")
+	}
+
+	if err = publisher.CreateTopic(protocol.InboxPrefix+"orders", protocol.TopicConfig{}); err == nil {
+		t.Fatalf("Expected error creating a topic with the inbox prefix got none")
+	}
+	if err = publisher.CreateTopic("orders", protocol.TopicConfig{MaxDeliveries: 3}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	// Existing topic keeps its config
+	if err = publisher.CreateTopic("orders", protocol.TopicConfig{}); err == nil {
+		t.Fatalf("Expected error creating an existing topic got none")
+	}
+	if err = b.AddTopic("orders"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Subscribe("orders"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"orders","message":"first"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	info, err := publisher.TopicInfo("orders")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if info.Config.MaxDeliveries != 3 || info.NextOffset != 1 || info.Subscribers != 1 || info.Queued != 1 {
+		t.Errorf("Expected orders with 1 subscriber and 1 queued item got %+v", *info)
+	}
+	topics, err := publisher.ListTopics()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(topics) != 1 || topics[0].Name != "orders" {
+		t.Errorf("Expected only the orders topic got %+v", topics)
+	}
+
+	if err = publisher.DeleteTopic("orders"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err = subscriber.Receive("orders"); err == nil {
+		t.Errorf("Expected error receiving from a deleted topic got none")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "orders")); !os.IsNotExist(err) {
+		t.Errorf("Expected the log of the deleted topic to be removed got %v", err)
+	}
+	if err = publisher.DeleteTopic("orders"); err == nil {
+		t.Errorf("Expected error deleting an unknown topic got none")
+	}
+}
+
+func TestAutoCreateTopics(t *testing.T) {
+	b := New("127.0.0.1:3104", WithAutoCreateTopics())
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3104")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("orders"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err = b.TopicInfo("orders"); err != nil {
+		t.Fatalf("Expected orders to be created on subscribe got %s", err)
+	}
+	// Topics are only auto-created by publishing and subscribing
+	if _, err = subscriber.Receive("payments"); err == nil {
+		t.Errorf("Expected error receiving from an unknown topic got none")
+	}
+	if _, err = b.TopicInfo("payments"); err == nil {
+		t.Errorf("Expected payments not to be created by RECV")
+	}
+}
+
+func TestTopicOverflow(t *testing.T) {
+	b := New("127.0.0.1:3105")
+	b.AddTopic("reject", WithMaxItems(2))
+	b.AddTopic("oldest", WithMaxItems(2), WithOverflowPolicy(OverflowDropOldest))
+	b.AddTopic("newest", WithTopicConfig(TopicConfig{MaxBytes: 10, Overflow: OverflowDropNewest}))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3105")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	publisher, err := client.NewPublisher("127.0.0.1:3105")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, topic := range []string{"reject", "oldest", "newest"} {
+		if err = subscriber.Subscribe(topic); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		for i := 0; i < 3; i++ {
+			err = publisher.Publish(fmt.Sprintf(`{"topic":"%s","message":"item%d"}`, topic, i))
+			if topic == "reject" && i == 2 {
+				if err == nil {
+					t.Errorf("Expected publishing to a full topic to be rejected")
+				}
+			} else if err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+		}
+	}
+
+	expected := map[string][]string{
+		"reject": {"item0", "item1"},
+		"oldest": {"item1", "item2"},
+		"newest": {"item0", "item1"}, // Each item is 5 bytes
+	}
+	for topic, messages := range expected {
+		for _, message := range messages {
+			msg, err := subscriber.Receive(topic)
+			if err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+			if msg.Payload.Message != message {
+				t.Errorf("Expected %s to deliver %s got %s", topic, message, msg.Payload.Message)
+			}
+		}
+		if _, err := subscriber.Receive(topic); err == nil {
+			t.Errorf("Expected %s to be empty", topic)
+		}
+	}
+	for topic, dropped := range map[string]int64{"reject": 0, "oldest": 1, "newest": 1} {
+		if info, err := b.TopicInfo(topic); err != nil || info.Dropped != dropped {
+			t.Errorf("Expected %d items dropped from %s got %+v (%v)", dropped, topic, info, err)
+		}
+	}
+
+	// Scheduled item that comes due into a full queue is dropped instead of the items already accepted
+	for i := 3; i < 5; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"reject","message":"item%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if _, err = publisher.PublishWith("reject", []byte("later"), client.PublishOptions{Delay: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if info, err := b.TopicInfo("reject"); err != nil || info.Dropped != 1 || info.Queued != 2 || info.Scheduled != 0 {
+		t.Errorf("Expected the due item to be dropped from the full queue got %+v (%v)", info, err)
+	}
+	for i := 3; i < 5; i++ {
+		msg, err := subscriber.Receive("reject")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if msg.Payload.Message != fmt.Sprintf("item%d", i) {
+			t.Errorf("Expected item%d got %s", i, msg.Payload.Message)
+		}
+	}
+}
+
+func TestTopicTTL(t *testing.T) {
+	b := New("127.0.0.1:3106")
+	b.AddTopic("default", WithTTL(100*time.Millisecond))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3106")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3106")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"default","message":"short"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	// TTL of the message overrides the topic's TTL
+	if err = publisher.Publish(`{"topic":"default","message":"long","ttl":10000}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	msg, err := subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "long" {
+		t.Errorf("Expected the expired message to be skipped got %s", msg.Payload.Message)
+	}
+	if info, err := b.TopicInfo("default"); err != nil || info.Expired != 1 {
+		t.Errorf("Expected 1 expired item got %+v (%v)", info, err)
+	}
+}
+
+func TestTopicRetention(t *testing.T) {
+	b := New("127.0.0.1:3116")
+	b.AddTopic("default", WithRetentionItems(2))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3116")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3116")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"item%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if info, err := b.TopicInfo("default"); err != nil || info.FirstOffset != 2 || info.NextOffset != 4 {
+		t.Errorf("Expected the topic to keep offsets 2-3 got %+v (%v)", info, err)
+	}
+
+	// Items that fell out of the retention are still delivered to the subscriptions they were queued for
+	for i := 0; i < 4; i++ {
+		msg, err := subscriber.Receive("default")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if msg.Payload.Message != fmt.Sprintf("item%d", i) {
+			t.Errorf("Expected item%d got %s", i, msg.Payload.Message)
+		}
+	}
+	// but seeking back only reaches the items kept
+	if err = subscriber.SeekToEarliest("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Offset != 2 {
+		t.Errorf("Expected to seek back to offset 2 got %d", msg.Payload.Offset)
+	}
+
+	if err = b.AddTopic("default", WithRetentionAge(50*time.Millisecond)); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if info, err := b.TopicInfo("default"); err != nil || info.FirstOffset != 4 || info.NextOffset != 4 {
+		t.Errorf("Expected every item to be older than the retention got %+v (%v)", info, err)
+	}
+
+	// Topics without their own retention keep only the default number of items
+	b.AddTopic("events")
+	for i := 0; i < DefaultRetentionItems+10; i++ {
+		if err = b.Topics["events"].store(newItem("", "item")); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if info, err := b.TopicInfo("events"); err != nil || info.FirstOffset != 10 || info.NextOffset != DefaultRetentionItems+10 {
+		t.Errorf("Expected the topic to keep the last %d items got %+v (%v)", DefaultRetentionItems, info, err)
+	}
+}
+
+func TestWildcardSubscription(t *testing.T) {
+	b := New("127.0.0.1:3107", WithAutoCreateTopics())
+	b.AddTopic("orders.eu.created")
+	b.AddTopic("orders.us.created")
+	b.AddTopic("payments.eu.created")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3107")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("orders.*.created"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Subscribe("orders.>.created"); err == nil {
+		t.Errorf("Expected error subscribing to an invalid pattern got none")
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3107")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"orders.*.created","message":"pattern"}`); err == nil {
+		t.Errorf("Expected error publishing to a pattern got none")
+	}
+	if err = publisher.Publish(`{"topic":"payments.eu.created","message":"payment"}`); err == nil {
+		t.Errorf("Expected payments.eu.created not to be subscribed to")
+	}
+	// Topic created after subscribing is matched as well
+	if err = publisher.Publish(`{"topic":"orders.asia.created","message":"asia"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"orders.eu.created","message":"eu"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	received := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		msg, err := subscriber.Receive("orders.*.created")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		received[msg.Payload.Topic] = msg.Payload.Message
+	}
+	if received["orders.asia.created"] != "asia" || received["orders.eu.created"] != "eu" {
+		t.Errorf("Expected asia and eu from their topics got %v", received)
+	}
+	if _, err = subscriber.Receive("orders.*.created"); err == nil {
+		t.Errorf("Expected error receiving from empty topics got none")
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		publisher.Publish(`{"topic":"orders.us.created","message":"us"}`)
+	}()
+	msg, err := subscriber.ReceiveWait("orders.*.created", 2*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Topic != "orders.us.created" || msg.Payload.Message != "us" {
+		t.Errorf("Expected us from orders.us.created got %s from %s", msg.Payload.Message, msg.Payload.Topic)
+	}
+}
+
+func TestTopicTrie(t *testing.T) {
+	trie := newTopicTrie()
+	for _, name := range []string{"orders", "orders.eu", "orders.eu.created", "orders.us.created"} {
+		trie.addTopic(newDefaultTopic(name, name))
+	}
+	expected := map[string]int{"orders.*": 1, "orders.>": 3, "*.*.created": 2, "orders.eu": 1, ">": 4, "payments.>": 0}
+	for pattern, n := range expected {
+		if topics := trie.matchTopics(pattern); len(topics) != n {
+			t.Errorf("Expected %s to match %d topics got %d", pattern, n, len(topics))
+		}
+	}
+	subscriber := &Subscriber{id: "subscriber"}
+	trie.addWildcard(&wildcardSubscription{pattern: "orders.*.created", subscriber: subscriber})
+	trie.addWildcard(&wildcardSubscription{pattern: "*.>", subscriber: &Subscriber{id: "other"}})
+	if matches := trie.matchWildcards("orders.asia.created"); len(matches) != 2 {
+		t.Errorf("Expected 2 wildcard subscriptions to match got %d", len(matches))
+	}
+	trie.removeSubscriber("subscriber")
+	if matches := trie.matchWildcards("orders.asia.created"); len(matches) != 1 {
+		t.Errorf("Expected 1 wildcard subscription to match got %d", len(matches))
+	}
+	if trie.removeWildcard("*.>", "subscriber") || !trie.removeWildcard("*.>", "other") {
+		t.Errorf("Expected only the wildcard subscription of the subscriber to the pattern to be removed")
+	}
+	if matches := trie.matchWildcards("orders.asia.created"); len(matches) != 0 {
+		t.Errorf("Expected no wildcard subscription to match got %d", len(matches))
+	}
+	trie.removeTopic("orders.eu.created")
+	if topics := trie.matchTopics("orders.>"); len(topics) != 2 {
+		t.Errorf("Expected 2 topics left got %d", len(topics))
+	}
+}
+
+func TestGenerateIdConcurrently(t *testing.T) {
+	const n = 1000
+	idCh := make(chan string, 4*n)
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func() {
+			for i := 0; i < n; i++ {
+				idCh <- generateId()
+			}
+			done <- struct{}{}
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+	close(idCh)
+	seen := make(map[string]bool)
+	for id := range idCh {
+		if seen[id] {
+			t.Fatalf("Duplicate id %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestPublishDeduplication(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3108", WithDataDir(dir))
+	b.AddTopic("default", WithDedupWindow(time.Second))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3108", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3108")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	id, err := publisher.PublishWith("default", []byte("first"), client.PublishOptions{DedupKey: "producer-1:1"})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	// Retried publish is acknowledged with the id of the original message
+	retried, err := publisher.PublishWith("default", []byte("first"), client.PublishOptions{DedupKey: "producer-1:1"})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if retried != id {
+		t.Errorf("Expected the duplicate to get id %s got %s", id, retried)
+	}
+	if _, err = publisher.PublishWith("default", []byte("second"), client.PublishOptions{DedupKey: "producer-1:2"}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if info, err := b.TopicInfo("default"); err != nil || info.NextOffset != 2 || info.Queued != 2 {
+		t.Errorf("Expected 2 items in the topic got %+v (%v)", info, err)
+	}
+	b.Stop()
+
+	// Keys are restored from the log together with the items
+	restored := New("127.0.0.1:3108", WithDataDir(dir))
+	defer restored.Stop()
+	restored.AddTopic("default", WithDedupWindow(time.Second))
+	topic := restored.Topics["default"]
+	if original, err := topic.addItem(&Item{Data: "first", DedupKey: "producer-1:1"}); err != nil || original.Id != id {
+		t.Errorf("Expected the restored topic to drop the duplicate of %s got %+v (%v)", id, original, err)
+	}
+	time.Sleep(time.Second)
+	if item, err := topic.addItem(&Item{Data: "first", DedupKey: "producer-1:1"}); err != nil || item.Id == id {
+		t.Errorf("Expected the key to be forgotten once the window passed got %+v (%v)", item, err)
+	}
+}
+
+func TestScheduledDelivery(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3109", WithDataDir(dir))
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3109", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3109")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err = publisher.PublishWith("default", []byte("later"), client.PublishOptions{Delay: 300 * time.Millisecond}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"default","message":"now"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if info, err := b.TopicInfo("default"); err != nil || info.Scheduled != 1 || info.Queued != 1 {
+		t.Errorf("Expected 1 scheduled and 1 queued item got %+v (%v)", info, err)
+	}
+	msg, err := subscriber.Receive("default")
+	if err != nil || msg.Payload.Message != "now" {
+		t.Fatalf("Expected the message without a delay first got %+v (%v)", msg, err)
+	}
+	start := time.Now()
+	msg, err = subscriber.ReceiveWait("default", time.Second)
+	if err != nil || msg.Payload.Message != "later" {
+		t.Fatalf("Expected the delayed message got %+v (%v)", msg, err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("Expected the delayed message to be held back got it after %s", waited)
+	}
+
+	// Item is queued to the subscriptions that exist once it's due, before and after a restart
+	if _, err = publisher.PublishWith("default", []byte("handover"), client.PublishOptions{Delay: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	late, err := client.NewSubscriber("127.0.0.1:3109", client.WithDurableName("shipping"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer late.Close()
+	if err = late.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Scheduled items survive a restart
+	deliverAt := time.Now().Add(500 * time.Millisecond)
+	if _, err = publisher.PublishWith("default", []byte("reminder"), client.PublishOptions{DeliverAt: deliverAt}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	b.Stop()
+
+	restored := New("127.0.0.1:3109", WithDataDir(dir))
+	defer restored.Stop()
+	// Handover is queued for both subscriptions
+	if info, err := restored.TopicInfo("default"); err != nil || info.Scheduled != 1 || info.Subscriptions != 2 || info.Queued != 2 {
+		t.Errorf("Expected the restored item to stay scheduled and handover queued for both subscriptions got %+v (%v)", info, err)
+	}
+	time.Sleep(time.Until(deliverAt) + 100*time.Millisecond)
+	if info, err := restored.TopicInfo("default"); err != nil || info.Scheduled != 0 || info.Queued != 4 {
+		t.Errorf("Expected the restored item to be queued once due got %+v (%v)", info, err)
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	b := New("127.0.0.1:3110")
+	b.AddTopic("alerts", WithPriorities())
+	b.AddTopic("default")
+	b.AddTopic("bounded", WithPriorities(), WithMaxItems(2), WithOverflowPolicy(OverflowDropOldest))
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3110")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	publisher, err := client.NewPublisher("127.0.0.1:3110")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	published := []struct {
+		message  string
+		priority int
+	}{{"bulk-1", 0}, {"urgent-1", 5}, {"bulk-2", 0}, {"urgent-2", 5}, {"warning", 2}}
+	for _, topic := range []string{"alerts", "default"} {
+		if err = subscriber.Subscribe(topic); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		for _, p := range published {
+			if _, err = publisher.PublishWith(topic, []byte(p.message), client.PublishOptions{Priority: p.priority}); err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+		}
+	}
+
+	// Items of the same priority keep the order they were published in. Topic without priorities ignores them
+	for topic, expected := range map[string][]string{
+		"alerts":  {"urgent-1", "urgent-2", "warning", "bulk-1", "bulk-2"},
+		"default": {"bulk-1", "urgent-1", "bulk-2", "urgent-2", "warning"},
+	} {
+		for _, message := range expected {
+			msg, err := subscriber.Receive(topic)
+			if err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+			if msg.Payload.Message != message {
+				t.Errorf("Expected %s from %s got %s", message, topic, msg.Payload.Message)
+			}
+		}
+	}
+
+	// Full topic drops the oldest item of the lowest priority, not the most urgent one
+	if err = subscriber.Subscribe("bounded"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, p := range []struct {
+		message  string
+		priority int
+	}{{"urgent", 9}, {"bulk-old", 0}, {"bulk-new", 0}} {
+		if _, err = publisher.PublishWith("bounded", []byte(p.message), client.PublishOptions{Priority: p.priority}); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	for _, message := range []string{"urgent", "bulk-new"} {
+		msg, err := subscriber.Receive("bounded")
+		if err != nil || msg.Payload.Message != message {
+			t.Errorf("Expected %s from bounded got %+v (%v)", message, msg, err)
+		}
+	}
+}
+
+func TestRetainedMessages(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3111", WithDataDir(dir))
+	b.AddTopic("config")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	publisher, err := client.NewPublisher("127.0.0.1:3111")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	// Retained messages are accepted before anybody subscribes
+	for _, message := range []string{"v1", "v2"} {
+		if _, err = publisher.PublishWith("config", []byte(message), client.PublishOptions{Retain: true}); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		subscriber, err := client.NewSubscriber("127.0.0.1:3111")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		defer subscriber.Close()
+		if err = subscriber.Subscribe("config"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		msg, err := subscriber.Receive("config")
+		if err != nil || msg.Payload.Message != "v2" || !msg.Payload.Retain {
+			t.Errorf("Expected the new subscription to get the retained v2 got %+v (%v)", msg, err)
+		}
+	}
+	b.Stop()
+
+	restored := New("127.0.0.1:3111", WithDataDir(dir))
+	if err := restored.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if info, err := restored.TopicInfo("config"); err != nil || !info.Retained {
+		t.Errorf("Expected the retained item to be restored got %+v (%v)", info, err)
+	}
+	publisher, err = client.NewPublisher("127.0.0.1:3111")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.ClearRetained("config"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	subscriber, err := client.NewSubscriber("127.0.0.1:3111")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("config"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg, err := subscriber.Receive("config"); err == nil {
+		t.Errorf("Expected no message after the retained item was cleared got %s", msg.Payload.Message)
+	}
+	restored.Stop()
+
+	cleared := New("127.0.0.1:3111", WithDataDir(dir))
+	defer cleared.Stop()
+	if info, err := cleared.TopicInfo("config"); err != nil || info.Retained {
+		t.Errorf("Expected the retained item to stay cleared after a restart got %+v (%v)", info, err)
+	}
+}
+
+func TestDurableSubscription(t *testing.T) {
+	dir := t.TempDir()
+	b := New("127.0.0.1:3112", WithDataDir(dir))
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	subscriber, err := client.NewSubscriber("127.0.0.1:3112", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := client.NewPublisher("127.0.0.1:3112")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, message := range []string{"first", "second"} {
+		if err = publisher.PublishMessage("default", []byte(message)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if _, err = subscriber.Receive("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	subscriber.Close()
+	time.Sleep(100 * time.Millisecond)
+	// Subscription keeps collecting items while the subscriber is away
+	if err = publisher.PublishMessage("default", []byte("third")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	reconnected, err := client.NewSubscriber("127.0.0.1:3112", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer reconnected.Close()
+	for _, message := range []string{"second", "third"} {
+		msg, err := reconnected.Receive("default")
+		if err != nil || msg.Payload.Message != message {
+			t.Fatalf("Expected %s from the re-attached subscription got %+v (%v)", message, msg, err)
+		}
+	}
+	if created, err := reconnected.SubscribeWithStatus("default", client.SubscribeOptions{}); err != nil || created {
+		t.Errorf("Expected to re-attach to the durable subscription got %t (%v)", created, err)
+	}
+	if err = publisher.PublishMessage("default", []byte("fourth")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	b.Stop()
+
+	// Durable subscriptions survive a restart and expire if the subscriber doesn't come back
+	restored := New("127.0.0.1:3112", WithDataDir(dir), WithDurableExpiry(300*time.Millisecond))
+	if err := restored.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer restored.Stop()
+	subscriber, err = client.NewSubscriber("127.0.0.1:3112", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("default")
+	if err != nil || msg.Payload.Message != "fourth" {
+		t.Fatalf("Expected fourth from the restored subscription got %+v (%v)", msg, err)
+	}
+	subscriber.Close()
+	time.Sleep(500 * time.Millisecond)
+	if info, err := restored.TopicInfo("default"); err != nil || info.Subscriptions != 0 {
+		t.Errorf("Expected the abandoned subscription to expire got %+v (%v)", info, err)
+	}
+}
+
+func TestPublishAndSubscribeOverOneConnection(t *testing.T) {
+	b := New("127.0.0.1:3113")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	for _, name := range []string{"", "inventory"} {
+		c, err := client.NewClient("127.0.0.1:3113", client.WithDurableName(name))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if err = c.Subscribe("default"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if err = c.PublishMessage("default", []byte("own message")); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		msg, err := c.Receive("default")
+		if err != nil || msg.Payload.Message != "own message" {
+			t.Fatalf("Expected the client to receive its own message got %+v (%v)", msg, err)
+		}
+		if err = c.Unsubscribe("default"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		c.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.publishers) != 0 || len(b.subscribers) != 0 {
+		t.Errorf("Expected both roles to be removed on disconnect got %d publishers and %d subscribers", len(b.publishers), len(b.subscribers))
+	}
+}
+
+func TestDurableSubscriberDisconnectsWhileWaiting(t *testing.T) {
+	b := New("127.0.0.1:3114")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+	publisher, err := client.NewPublisher("127.0.0.1:3114")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer publisher.Close()
+
+	// Client with request ids
+	subscriber, err := client.NewSubscriber("127.0.0.1:3114", client.WithDurableName("billing"))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	go subscriber.ReceiveWait("default", 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	subscriber.Close()
+
+	// Client of the text protocol that doesn't send request ids
+	conn, err := net.Dial("tcp", "127.0.0.1:3114")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{`SUBREG {"name":"audit"}`, `SUB {"topic":"default"}`} {
+		fmt.Fprintln(conn, line)
+		if reply, err := reader.ReadString('\n'); err != nil || reply != "OK\n" && reply[:3] != "OK " {
+			t.Fatalf("Expected OK to %s got %q (%v)", line, reply, err)
+		}
+	}
+	fmt.Fprintln(conn, `RECV {"topic":"default","wait":5000}`)
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Receives parked by the dropped connections don't take the item
+	if err = publisher.PublishMessage("default", []byte("important")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, name := range []string{"billing", "audit"} {
+		reconnected, err := client.NewSubscriber("127.0.0.1:3114", client.WithDurableName(name))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		msg, err := reconnected.Receive("default")
+		if err != nil || msg.Payload.Message != "important" {
+			t.Errorf("Expected %s to get important after reconnecting got %+v (%v)", name, msg, err)
+		}
+		reconnected.Close()
+	}
+}
@@ -3,82 +3,205 @@ package broker
 import (
 	"fmt"
 	"net"
+	"sync"
+
+	"github.com/marcell7/MQ/protocol"
 )
 
 type Client interface {
-	sendResp(*Item) error
+	sendResp(string, *Item) error
 	sendOk() error
 	sendError(string) error
 }
 
-type Publisher struct {
-	id   string
-	conn net.Conn
+// Connection of a client together with the protocol negotiated for it
+type connection struct {
+	conn     net.Conn
+	protocol protocol.Protocol
+	writeMu  *sync.Mutex // mutex for writing to the connection. Replies and pushed items are written from different goroutines
+	request  string      // Id of the request the messages sent through this view of the connection reply to. Empty for pushed items
 }
 
-func newPublisher(id string, conn net.Conn) *Publisher {
-	return &Publisher{
-		id:   id,
-		conn: conn,
+// Constructor for the connection struct
+func newConnection(conn net.Conn, proto protocol.Protocol) *connection {
+	return &connection{
+		conn:     conn,
+		protocol: proto,
+		writeMu:  new(sync.Mutex),
 	}
 }
 
-func (p *Publisher) sendOk() error {
-	_, err := p.conn.Write([]byte("OK\n"))
+// Returns a view of the connection whose messages echo the id of the request they reply to
+func (c *connection) reply(request string) *connection {
+	return &connection{
+		conn:     c.conn,
+		protocol: c.protocol,
+		writeMu:  c.writeMu,
+		request:  request,
+	}
+}
+
+// Encodes the message with the connection's protocol and writes it to the connection
+func (c *connection) send(command protocol.Command, payload *protocol.DefaultPayload) error {
+	if c.request != "" {
+		if payload == nil {
+			payload = new(protocol.DefaultPayload)
+		}
+		payload.Request = c.request
+	}
+	data, err := c.protocol.Encode(&protocol.DefaultMessage{Command: command, Payload: payload})
 	if err != nil {
 		return err
 	}
-	return nil
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(data)
+	return err
 }
 
-func (p *Publisher) sendResp(item *Item) error {
-	return nil
+func (c *connection) sendOk() error {
+	return c.send(protocol.CMD_OK, nil)
 }
 
-func (p *Publisher) sendError(errorMsg string) error {
-	payload := fmt.Sprintf(`{"error":"%s"}`, errorMsg)
-	_, err := p.conn.Write([]byte(fmt.Sprintf("ERROR %s\n", payload)))
-	if err != nil {
-		return err
+func (c *connection) sendError(errorMsg string) error {
+	return c.send(protocol.CMD_ERROR, &protocol.DefaultPayload{Error: errorMsg})
+}
+
+// Replies to TOPIC_LIST and TOPIC_INFO
+func (c *connection) sendTopics(infos []TopicInfo) error {
+	topics := make([]protocol.TopicInfo, 0, len(infos))
+	for _, info := range infos {
+		topics = append(topics, protocol.TopicInfo{
+			Name:          info.Name,
+			Config:        info.Config.wire(),
+			FirstOffset:   info.FirstOffset,
+			NextOffset:    info.NextOffset,
+			Subscriptions: info.Subscriptions,
+			Subscribers:   info.Subscribers,
+			Queued:        info.Queued,
+			Inflight:      info.Inflight,
+			Dropped:       info.Dropped,
+			Expired:       info.Expired,
+			Scheduled:     info.Scheduled,
+			Retained:      info.Retained,
+		})
 	}
-	return nil
+	return c.send(protocol.CMD_TOPICS, &protocol.DefaultPayload{Topics: topics})
 }
 
-type Subscriber struct {
-	id   string
-	conn net.Conn
+// Acknowledges the publish with the id, offset and sequence number the item got. Duplicate is acknowledged with the item published first
+func (c *connection) sendPublished(topic string, item *Item, duplicate bool) error {
+	return c.send(protocol.CMD_OK, &protocol.DefaultPayload{
+		Topic:     topic,
+		Id:        item.Id,
+		Offset:    item.Offset,
+		Timestamp: item.Timestamp,
+		Sequence:  item.Sequence,
+		Duplicate: duplicate,
+	})
 }
 
-func newSubscriber(id string, conn net.Conn) *Subscriber {
-	return &Subscriber{
-		id:   id,
-		conn: conn,
+// Delivers the item to the client
+func (c *connection) sendResp(topic string, item *Item) error {
+	payload := &protocol.DefaultPayload{
+		Topic:     topic,
+		Message:   item.Data,
+		Headers:   item.Headers,
+		Id:        item.Id,
+		Offset:    item.Offset,
+		Timestamp: item.Timestamp,
+		Sequence:  item.Sequence,
+		ReplyTo:   item.ReplyTo,
+		Priority:  item.Priority,
+		Retain:    item.Retain,
+	}
+	if dl := item.DeadLetter; dl != nil {
+		payload.DeadLetter = &protocol.DeadLetter{
+			Topic:    dl.Topic,
+			Offset:   dl.Offset,
+			Attempts: dl.Attempts,
+			Reason:   dl.Reason,
+		}
 	}
+	return c.send(protocol.CMD_RESP, payload)
 }
 
-func (s *Subscriber) sendOk() error {
-	_, err := s.conn.Write([]byte("OK\n"))
-	if err != nil {
-		return err
+// Tells the subscriber that no item arrived while its RECV was waiting
+func (c *connection) sendEmpty(topic string) error {
+	return c.send(protocol.CMD_EMPTY, &protocol.DefaultPayload{Topic: topic})
+}
+
+type Publisher struct {
+	id string
+	*connection
+}
+
+func newPublisher(id string, conn *connection) *Publisher {
+	return &Publisher{
+		id:         id,
+		connection: conn,
 	}
-	return nil
 }
 
-func (s *Subscriber) sendResp(item *Item) error {
-	payload := fmt.Sprintf(`{"message":"%s"}`, item.Data)
-	_, err := s.conn.Write([]byte(fmt.Sprintf("RESP %s\n", payload)))
-	if err != nil {
-		return err
+type Subscriber struct {
+	id string
+	*connection
+	mu     sync.Mutex // mutex for the outbox
+	cond   *sync.Cond // signals that the outbox changed
+	outbox []*push    // items waiting to be pushed to the subscriber
+	closed bool       // Set once the connection is dropped
+}
+
+// Item pushed to a streaming subscriber
+type push struct {
+	topic string
+	item  *Item
+}
+
+func newSubscriber(id string, conn *connection) *Subscriber {
+	s := &Subscriber{
+		id:         id,
+		connection: conn,
 	}
-	return nil
+	s.cond = sync.NewCond(&s.mu)
+	go s.startPushing()
+	return s
+}
 
+// Queues the item to be pushed to the subscriber without waiting for the write
+func (s *Subscriber) push(topic string, item *Item) {
+	s.mu.Lock()
+	s.outbox = append(s.outbox, &push{topic: topic, item: item})
+	s.mu.Unlock()
+	s.cond.Signal()
 }
 
-func (s *Subscriber) sendError(errorMsg string) error {
-	payload := fmt.Sprintf(`{"error":"%s"}`, errorMsg)
-	_, err := s.conn.Write([]byte(fmt.Sprintf("ERROR %s\n", payload)))
-	if err != nil {
-		return err
+// Writes queued items to the connection in the order they were pushed
+func (s *Subscriber) startPushing() {
+	for {
+		s.mu.Lock()
+		for len(s.outbox) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		outbox := s.outbox
+		s.outbox = nil
+		s.mu.Unlock()
+		for _, p := range outbox {
+			if err := s.sendResp(p.topic, p.item); err != nil {
+				fmt.Printf("error pushing to subscriber %s: %s\n", s.id, err)
+			}
+		}
 	}
-	return nil
+}
+
+// Stops pushing items to the subscriber
+func (s *Subscriber) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
 }
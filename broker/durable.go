@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	durablePrefix        = "durable:" // Prefix of the ids of subscribers registered with a durable name
+	defaultDurableExpiry = time.Hour  // Time after which subscriptions of a durable subscriber that didn't reconnect are deleted
+)
+
+// Id of the subscriber registered with the durable name. Stays the same across connections
+func durableSubscriberId(name string) string {
+	return durablePrefix + name
+}
+
+// Reports whether the subscriber (or subscription) id belongs to a durable subscriber
+func isDurable(id string) bool {
+	return strings.HasPrefix(id, durablePrefix)
+}
+
+// Registers the durable subscriber and attaches it to the subscriptions it left behind when it disconnected.
+// Connection still registered under the same name is taken over - it is closed and its subscriptions move to the new one
+func (b *Broker) attachDurable(subscriber *Subscriber) {
+	b.mu.Lock()
+	previous := b.subscribers[subscriber.id]
+	b.subscribers[subscriber.id] = subscriber
+	delete(b.abandoned, subscriber.id)
+	topics := make([]*DefaultTopic, 0, len(b.Topics))
+	for _, topic := range b.Topics {
+		topics = append(topics, topic)
+	}
+	b.mu.Unlock()
+	if previous != nil {
+		previous.close()
+		previous.conn.Close()
+	}
+	for _, topic := range topics {
+		topic.attach(subscriber.id, subscriber)
+	}
+}
+
+// Detaches the disconnected durable subscriber from its subscriptions. Subscriptions keep their queues until the subscriber
+// reconnects or they expire. Wildcard subscriptions are not kept - the subscriber has to subscribe to the patterns again
+func (b *Broker) detachDurable(subscriber *Subscriber) {
+	b.mu.Lock()
+	if b.subscribers[subscriber.id] != subscriber {
+		// Connection was taken over by a new one
+		b.mu.Unlock()
+		return
+	}
+	delete(b.subscribers, subscriber.id)
+	b.topics.removeSubscriber(subscriber.id)
+	b.abandon(subscriber.id)
+	topics := make([]*DefaultTopic, 0, len(b.Topics))
+	for _, topic := range b.Topics {
+		topics = append(topics, topic)
+	}
+	b.mu.Unlock()
+	for _, topic := range topics {
+		topic.detach(subscriber.id, subscriber)
+	}
+}
+
+// Starts the expiry of the subscriptions of the durable subscriber that is not connected. b.mu has to be held
+func (b *Broker) abandon(id string) {
+	if b.durableExpiry <= 0 {
+		return
+	}
+	b.abandoned[id] = time.Now()
+	time.AfterFunc(b.durableExpiry, func() {
+		b.expireDurable(id)
+	})
+}
+
+// Deletes the subscriptions of the durable subscriber unless it reconnected in the meantime
+func (b *Broker) expireDurable(id string) {
+	b.mu.Lock()
+	since, ok := b.abandoned[id]
+	if !ok || time.Since(since) < b.durableExpiry {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.abandoned, id)
+	topics := make([]*DefaultTopic, 0, len(b.Topics))
+	for _, topic := range b.Topics {
+		topics = append(topics, topic)
+	}
+	b.mu.Unlock()
+	for _, topic := range topics {
+		topic.deleteSubscription(id)
+	}
+}
+
+// Attaches the reconnected durable subscriber to its subscription in the topic
+func (dt *DefaultTopic) attach(id string, subscriber *Subscriber) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, ok := dt.Subscriptions[dt.members[id]]
+	if !ok {
+		return
+	}
+	if subscription.group != "" {
+		subscription.members[id] = subscriber
+	} else {
+		subscription.subscriber = subscriber
+	}
+	// Items are pushed again once the subscriber asks for it with SUB
+	subscription.setStreaming(id, false, 0)
+}
+
+// Detaches the disconnected durable subscriber from its subscription in the topic.
+// Subscription keeps its queue and the items the subscriber did not acknowledge are redelivered
+func (dt *DefaultTopic) detach(id string, subscriber *Subscriber) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, ok := dt.Subscriptions[dt.members[id]]
+	if !ok || subscription.member(id) != subscriber {
+		return
+	}
+	subscription.setStreaming(id, false, 0)
+	for _, d := range subscription.inflight {
+		if d.subscriber == id {
+			dt.requeue(subscription, d)
+		}
+	}
+}
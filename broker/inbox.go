@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/marcell7/MQ/protocol"
+)
+
+// Ephemeral destination of the reply to a request. Inbox is not a topic - the reply is not stored, it is written
+// straight to the connection of the requester. Inbox is dropped once it gets its reply, the requester stops waiting
+// for it or the requester disconnects
+type inbox struct {
+	owner string      // id of the client that created the inbox
+	conn  *connection // connection the reply is written to
+	timer *time.Timer // Drops the inbox once the requester stops waiting. nil if the requester waits until it disconnects
+}
+
+// Creates an inbox owned by the client and returns its name. Inbox is dropped after wait (if set) unless it gets a reply before
+func (b *Broker) createInbox(owner string, conn *connection, wait time.Duration) string {
+	name := protocol.InboxPrefix + generateId()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	inbox := &inbox{owner: owner, conn: conn}
+	if wait > 0 {
+		inbox.timer = time.AfterFunc(wait, func() {
+			b.mu.Lock()
+			delete(b.inboxes, name)
+			b.mu.Unlock()
+		})
+	}
+	b.inboxes[name] = inbox
+	return name
+}
+
+// Writes the reply to the requester waiting on the inbox and drops the inbox
+func (b *Broker) deliverReply(name string, item *Item) error {
+	b.mu.Lock()
+	inbox, ok := b.inboxes[name]
+	delete(b.inboxes, name)
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("inbox %s does not exist", name)
+	}
+	inbox.stop()
+	item.Id = generateId()
+	item.Timestamp = time.Now().UnixMilli()
+	item.Sequence = 1
+	return inbox.conn.sendResp(name, item)
+}
+
+// Drops every inbox of the client. Replies sent to them afterwards are rejected
+func (b *Broker) removeInboxes(owner string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, inbox := range b.inboxes {
+		if inbox.owner == owner {
+			inbox.stop()
+			delete(b.inboxes, name)
+		}
+	}
+}
+
+// Stops the timer dropping the inbox
+func (i *inbox) stop() {
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+}
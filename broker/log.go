@@ -0,0 +1,422 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentSize = 16 << 20 // Size (in bytes) after which the active segment is rolled over
+	segmentExt         = ".log"   // Extension of the segment files
+	tmpExt             = ".tmp"   // Extension added to a segment file while it is being written by a compaction
+	recordHeaderSize   = 8        // Every record is prefixed with its length and crc32 checksum (4 bytes each)
+)
+
+var errLogClosed = errors.New("topic log is closed")
+
+// SyncMode controls when writes to the topic log are flushed to stable storage
+type SyncMode int
+
+const (
+	SyncAlways   SyncMode = iota // fsync after every write, before the publish is acknowledged
+	SyncBatch                    // fsync after every SyncPolicy.BatchSize writes
+	SyncInterval                 // fsync in the background every SyncPolicy.Interval
+)
+
+// Describes how often the topic log is fsync'ed
+type SyncPolicy struct {
+	Mode      SyncMode      // When to fsync
+	BatchSize int           // Number of writes between two fsyncs (SyncBatch only)
+	Interval  time.Duration // Time between two fsyncs (SyncInterval only)
+}
+
+type recordType uint8
+
+const (
+	recordItem        recordType = iota + 1 // Item was published to the topic
+	recordSubscribe                         // Subscription was created
+	recordPop                               // Item was taken out of a subscription's queue
+	recordUnsubscribe                       // Subscription was deleted
+	recordSeek                              // Subscription's cursor was moved
+	recordRedrive                           // Items of a dead-letter topic were moved back to their original topics
+	recordUnretain                          // Retained item of the topic was cleared
+	recordDue                               // Scheduled item came due and was queued
+	recordSnapshot                          // Log was compacted. Starts a snapshot of the topic that replaces everything before it
+	recordQueue                             // Queue of a subscription was written out (snapshots only)
+	recordConfig                            // Config of the topic was changed
+)
+
+// Single entry in the topic log
+type logRecord struct {
+	Type         recordType   `json:"type"`
+	Subscription string       `json:"sub,omitempty"`     // id of the affected subscription
+	Group        string       `json:"group,omitempty"`   // name of the consumer group owning the subscription (recordSubscribe only)
+	Offset       int64        `json:"offset,omitempty"`  // offset of the consumed item (recordPop), the item that came due (recordDue), the new cursor position (recordSeek, recordRedrive) or the first item kept in the topic (recordSnapshot)
+	Item         *Item        `json:"item,omitempty"`    // published item (recordItem only)
+	Sequence     int64        `json:"seq,omitempty"`     // sequence number of the last item published to the topic (recordSnapshot only)
+	Offsets      []int64      `json:"offsets,omitempty"` // offsets of the items queued for the subscription in the order they are delivered (recordQueue only)
+	Config       *TopicConfig `json:"config,omitempty"`  // new config of the topic (recordConfig only)
+}
+
+// Append-only, segmented write-ahead log of a single topic.
+// Each segment is a file named after its sequence number that holds length-prefixed and checksummed records.
+// Compaction replaces the segments with a snapshot of the topic's state once they grow large enough.
+type topicLog struct {
+	dir         string        // Directory holding the segments of the topic
+	policy      SyncPolicy    // fsync policy
+	segmentSize int64         // Size after which the active segment is rolled over
+	mu          sync.Mutex    // mutex for writing to the active segment
+	file        *os.File      // Active segment
+	segment     int           // Sequence number of the active segment
+	size        int64         // Size of the active segment
+	unsynced    int           // Number of writes since the last fsync
+	closed      bool          // Set once the log is closed
+	rolled      bool          // Set once the log rolls over to a new segment after it was opened or compacted
+	written     int64         // Number of bytes appended since the log was opened or compacted
+	snapshot    int64         // Size of the snapshot written by the last compaction
+	compacting  bool          // Set while a compaction is pending
+	exitCh      chan struct{} // Channel used for stopping the background fsync (SyncInterval only)
+}
+
+// Opens (or creates) the log in dir and feeds every record already stored in it to replay
+func openTopicLog(dir string, policy SyncPolicy, segmentSize int64, replay func(*logRecord) error) (*topicLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	l := &topicLog{
+		dir:         dir,
+		policy:      policy,
+		segmentSize: segmentSize,
+		exitCh:      make(chan struct{}),
+	}
+	// Snapshot that was being written when the broker stopped is incomplete, the segments it would replace are still there
+	if stale, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt+tmpExt)); err == nil {
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	}
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		if err := l.replaySegment(segment, last, replay); err != nil {
+			return nil, err
+		}
+	}
+	if len(segments) > 0 {
+		l.segment = segments[len(segments)-1]
+	}
+	if err := l.openSegment(l.segment); err != nil {
+		return nil, err
+	}
+	if policy.Mode == SyncInterval && policy.Interval > 0 {
+		go l.syncPeriodically()
+	}
+	return l, nil
+}
+
+// Appends a record to the active segment and fsyncs it according to the policy
+func (l *topicLog) append(rec *logRecord) error {
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errLogClosed
+	}
+	n, err := l.file.Write(frame)
+	l.size += int64(n)
+	l.written += int64(n)
+	if err != nil {
+		return err
+	}
+	l.unsynced++
+	switch l.policy.Mode {
+	case SyncAlways:
+		err = l.sync()
+	case SyncBatch:
+		if l.unsynced >= l.policy.BatchSize {
+			err = l.sync()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if l.size >= l.segmentSize {
+		return l.roll()
+	}
+	return nil
+}
+
+// Reports whether the log should be compacted and marks the compaction as pending if so. Log is compacted once it
+// rolled over to a new segment and grew by more than its last snapshot, so that rewriting the snapshot pays for itself
+func (l *topicLog) startCompaction() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.compacting || !l.rolled || l.written < l.snapshot {
+		return false
+	}
+	l.compacting = true
+	return true
+}
+
+// Replaces every segment with a new one holding the records of the snapshot. The new segment becomes the active one.
+// Snapshot is written under a temporary name first, so that a crash never leaves a partial snapshot behind
+func (l *topicLog) compact(records []*logRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compacting = false
+	if l.closed {
+		return errLogClosed
+	}
+	segment := l.segment + 1
+	path := l.segmentPath(segment)
+	size, err := writeSegment(path+tmpExt, records)
+	if err != nil {
+		os.Remove(path + tmpExt)
+		return err
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		os.Remove(path + tmpExt)
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = 0
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := l.openSegment(segment); err != nil {
+		return err
+	}
+	l.rolled = false
+	l.written = 0
+	l.snapshot = size
+	// Snapshot replaces everything before it, so a crash while deleting the old segments loses nothing
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, old := range segments {
+		if old < segment {
+			if err := os.Remove(l.segmentPath(old)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flushes and closes the log. Any further append fails with errLogClosed
+func (l *topicLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.exitCh)
+	if err := l.sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Closes the log and deletes all of its segments
+func (l *topicLog) remove() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(l.dir)
+}
+
+func (l *topicLog) sync() error {
+	if l.unsynced == 0 {
+		return nil
+	}
+	l.unsynced = 0
+	return l.file.Sync()
+}
+
+func (l *topicLog) syncPeriodically() {
+	ticker := time.NewTicker(l.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if !l.closed {
+				if err := l.sync(); err != nil {
+					fmt.Printf("error syncing topic log %s: %s\n", l.dir, err)
+				}
+			}
+			l.mu.Unlock()
+		case <-l.exitCh:
+			return
+		}
+	}
+}
+
+// Closes the active segment and starts a new one
+func (l *topicLog) roll() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = 0
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.rolled = true
+	return l.openSegment(l.segment + 1)
+}
+
+func (l *topicLog) openSegment(segment int) error {
+	file, err := os.OpenFile(l.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.segment = segment
+	l.size = info.Size()
+	return nil
+}
+
+func (l *topicLog) segmentPath(segment int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", segment, segmentExt))
+}
+
+// Returns sequence numbers of all segments in the log directory in ascending order
+func (l *topicLog) segments() ([]int, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		var segment int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentExt), "%d", &segment); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// Reads every record in the segment. A torn or corrupted tail of the last segment
+// (e.g. caused by a crash in the middle of a write) is truncated, anywhere else it is an error.
+func (l *topicLog) replaySegment(segment int, last bool, replay func(*logRecord) error) error {
+	path := l.segmentPath(segment)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var offset int
+	for offset < len(data) {
+		rec, n, err := decodeRecord(data[offset:])
+		if err != nil {
+			if !last {
+				return fmt.Errorf("segment %s is corrupted at offset %d: %w", path, offset, err)
+			}
+			return os.Truncate(path, int64(offset))
+		}
+		if err := replay(rec); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// Writes the records to a new segment file and fsyncs it. Returns the size of the file
+func writeSegment(path string, records []*logRecord) (int64, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	var size int64
+	for _, rec := range records {
+		frame, err := encodeRecord(rec)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(frame)
+		size += int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return size, file.Close()
+}
+
+// Encodes the record prefixed with its length and checksum
+func encodeRecord(rec *logRecord) ([]byte, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, recordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(body))
+	copy(frame[recordHeaderSize:], body)
+	return frame, nil
+}
+
+// Decodes a single record from the beginning of data and returns it together with the number of bytes it occupied
+func decodeRecord(data []byte) (*logRecord, int, error) {
+	if len(data) < recordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	checksum := binary.BigEndian.Uint32(data[4:8])
+	if len(data) < recordHeaderSize+length {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	body := data[recordHeaderSize : recordHeaderSize+length]
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	rec := new(logRecord)
+	if err := json.Unmarshal(body, rec); err != nil {
+		return nil, 0, err
+	}
+	return rec, recordHeaderSize + length, nil
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Items waiting for their delivery time, ordered by it. Items due at the same time keep the order they were published in.
+// Implements heap.Interface
+type schedule []*Item
+
+func (s schedule) Len() int {
+	return len(s)
+}
+
+func (s schedule) Less(i, j int) bool {
+	if s[i].DeliverAt != s[j].DeliverAt {
+		return s[i].DeliverAt < s[j].DeliverAt
+	}
+	return s[i].Offset < s[j].Offset
+}
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s *schedule) Push(x any) {
+	*s = append(*s, x.(*Item))
+}
+
+func (s *schedule) Pop() any {
+	old := *s
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*s = old[:len(old)-1]
+	return item
+}
+
+// Holds the item back until its delivery time. The timer has to be re-armed afterwards
+func (dt *DefaultTopic) schedule(item *Item) {
+	item.scheduled = true
+	heap.Push(&dt.scheduled, item)
+}
+
+// Takes the item with the offset out of the schedule. Returns nil if it isn't scheduled
+func (dt *DefaultTopic) unschedule(offset int64) *Item {
+	for i, item := range dt.scheduled {
+		if item.Offset == offset {
+			heap.Remove(&dt.scheduled, i)
+			item.scheduled = false
+			return item
+		}
+	}
+	return nil
+}
+
+// Arms the timer to fire when the first scheduled item is due
+func (dt *DefaultTopic) armTimer() {
+	if dt.timer != nil {
+		dt.timer.Stop()
+		dt.timer = nil
+	}
+	if len(dt.scheduled) == 0 || dt.deleted {
+		return
+	}
+	dt.timer = time.AfterFunc(time.Until(time.UnixMilli(dt.scheduled[0].DeliverAt)), dt.deliverDue)
+}
+
+// Moves the items that are due to the queues of the subscriptions
+func (dt *DefaultTopic) deliverDue() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	now := time.Now()
+	for len(dt.scheduled) > 0 && dt.scheduled[0].due(now) {
+		item := heap.Pop(&dt.scheduled).(*Item)
+		item.scheduled = false
+		// Replay has to queue the item to the subscriptions that exist now, not when it was published
+		dt.persist(&logRecord{Type: recordDue, Offset: item.Offset})
+		dt.enqueue(item)
+		for _, subscription := range dt.Subscriptions {
+			dt.enforceLimits(subscription, item, now)
+		}
+	}
+	dt.armTimer()
+}
@@ -2,14 +2,54 @@ package broker
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
+var errEmptyQueue = errors.New("no items in the queue")
+
 type Subscription struct {
-	id         string       // id
-	subscriber *Subscriber  // subscriber
-	mu         sync.RWMutex // mutex for reading and writing to the queue
-	Queue      []*Item      // queue that holds published items
+	id         string                 // id
+	subscriber *Subscriber            // subscriber. nil for consumer group subscriptions and detached subscriptions restored from the log
+	group      string                 // name of the consumer group. Empty if the subscription belongs to a single subscriber
+	members    map[string]*Subscriber // subscribers sharing the queue of a consumer group subscription - {"<subscriber_id>":"<Subscriber>"}
+	streamers  []*streamer            // subscribers that get items pushed as they arrive instead of asking for them with RECV
+	next       int                    // index in streamers of the subscriber that gets the next pushed item (round-robin)
+	ack        bool                   // Delivered items have to be acknowledged, otherwise they are redelivered (at-least-once delivery)
+	ackTimeout time.Duration          // Time after which an unacknowledged item is redelivered
+	inflight   map[int64]*delivery    // Items delivered but not yet acknowledged - {"<offset>":"<delivery>"}
+	attempts   map[int64]int          // Number of times each not yet acknowledged item was delivered - {"<offset>":"<attempts>"}
+	reasons    map[int64]string       // Reason given in the last NACK of each not yet acknowledged item - {"<offset>":"<reason>"}
+	mu         sync.RWMutex           // mutex for reading and writing to the queue
+	changedCh  chan struct{}          // Channel closed the next time items are added to the queue. Used for waiting for items
+	Queue      []*Item                // queue that holds published items not yet consumed, ordered by their priority (highest first) and then by their arrival
+	bytes      int                    // Total size of the data of the items in the queue
+	draining   bool                   // Subscription gets no new items and is deleted once its queue is consumed
+}
+
+// Settings of a subscription requested by the subscriber
+type subscriptionOptions struct {
+	group      string        // Consumer group to join
+	ack        bool          // Delivered items have to be acknowledged
+	ackTimeout time.Duration // Time after which an unacknowledged item is redelivered
+	stream     bool          // Items are pushed to the subscriber as they arrive
+	prefetch   int           // Maximum number of pushed items that are not yet acknowledged (or credited). Unlimited if zero
+}
+
+// Subscriber that gets items pushed as they arrive
+type streamer struct {
+	id       string // id of the subscriber
+	prefetch int    // Maximum number of pushed items that are not yet acknowledged (or credited). Unlimited if zero
+	credits  int    // Number of items that can still be pushed to the subscriber
+}
+
+// Item handed to a subscriber that waits for an acknowledgement
+type delivery struct {
+	item       *Item       // delivered item
+	subscriber string      // id of the subscriber the item was delivered to
+	pushed     bool        // item was pushed to a streaming subscriber and took one of its credits
+	timer      *time.Timer // redelivers the item once the ack timeout expires
 }
 
 // Constructor for Subscription struct
@@ -17,24 +57,266 @@ func newSubscription(id string, subscriber *Subscriber) *Subscription {
 	return &Subscription{
 		id:         id,
 		subscriber: subscriber,
+		inflight:   make(map[int64]*delivery),
+		attempts:   make(map[int64]int),
+		reasons:    make(map[int64]string),
+	}
+}
+
+// Constructor for a Subscription shared by the members of a consumer group.
+// Every item in its queue is delivered to exactly one of the members.
+func newGroupSubscription(id string, group string) *Subscription {
+	return &Subscription{
+		id:       id,
+		group:    group,
+		members:  make(map[string]*Subscriber),
+		inflight: make(map[int64]*delivery),
+		attempts: make(map[int64]int),
+		reasons:  make(map[int64]string),
+	}
+}
+
+// Applies the settings requested by the subscriber
+func (s *Subscription) configure(opts subscriptionOptions) {
+	s.ack = opts.ack
+	s.ackTimeout = opts.ackTimeout
+}
+
+// Id of the subscription shared by the members of a consumer group
+func groupSubscriptionId(group string) string {
+	return "group:" + group
+}
+
+// Returns the subscriber with the given id consuming from the subscription
+func (s *Subscription) member(id string) *Subscriber {
+	if s.group != "" {
+		return s.members[id]
 	}
+	if s.subscriber != nil && s.subscriber.id == id {
+		return s.subscriber
+	}
+	return nil
 }
 
-// Add item to the queue
+// Turns pushing of items to the subscriber on or off.
+// With prefetch set at most that many items are pushed before they are acknowledged or credited back
+func (s *Subscription) setStreaming(id string, stream bool, prefetch int) {
+	for i, st := range s.streamers {
+		if st.id == id {
+			s.streamers = append(s.streamers[:i:i], s.streamers[i+1:]...)
+			break
+		}
+	}
+	if stream {
+		s.streamers = append(s.streamers, &streamer{id: id, prefetch: prefetch, credits: prefetch})
+	}
+}
+
+// Returns the streaming subscriber with the given id
+func (s *Subscription) streamer(id string) *streamer {
+	for _, st := range s.streamers {
+		if st.id == id {
+			return st
+		}
+	}
+	return nil
+}
+
+// Returns the streaming subscriber that should get the next item and takes one of its credits.
+// Streaming members of a group that have credits left take turns
+func (s *Subscription) nextStreamer() (string, *Subscriber) {
+	for i := 0; i < len(s.streamers); i++ {
+		s.next = s.next % len(s.streamers)
+		st := s.streamers[s.next]
+		s.next++
+		if st.prefetch == 0 {
+			return st.id, s.member(st.id)
+		}
+		if st.credits > 0 {
+			st.credits--
+			return st.id, s.member(st.id)
+		}
+	}
+	return "", nil
+}
+
+// Gives the streaming subscriber n more items it can be pushed
+func (s *Subscription) grant(id string, n int) {
+	if st := s.streamer(id); st != nil && st.prefetch > 0 {
+		st.credits += n
+	}
+}
+
+// Add item to the queue behind every item with the same or higher priority
 func (s *Subscription) addToQueue(item *Item) {
 	s.mu.Lock()
-	s.Queue = append(s.Queue, item)
+	i := len(s.Queue)
+	for i > 0 && s.Queue[i-1].Priority < item.Priority {
+		i--
+	}
+	s.insertAt(i, item)
 	s.mu.Unlock()
 }
 
-// Take the item out of the queue and return it
+// Returns a channel that is closed the next time items are added to the queue
+func (s *Subscription) changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changedCh == nil {
+		s.changedCh = make(chan struct{})
+	}
+	return s.changedCh
+}
+
+// Wakes up everybody waiting for items
+func (s *Subscription) notify() {
+	if s.changedCh != nil {
+		close(s.changedCh)
+		s.changedCh = nil
+	}
+}
+
+// Take the oldest item out of the queue and return it
 func (s *Subscription) popOut() (*Item, error) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.Queue) == 0 {
-		return nil, errors.New("queue is empty")
+		return nil, errEmptyQueue
 	}
-	currentItem := s.Queue[len(s.Queue)-1]
-	s.Queue = s.Queue[:len(s.Queue)-1]
-	s.mu.Unlock()
+	currentItem := s.Queue[0]
+	s.Queue = s.Queue[1:]
+	s.bytes -= len(currentItem.Data)
 	return currentItem, nil
 }
+
+// Take the oldest item of the lowest priority out of the queue. Without priorities this is the oldest item
+func (s *Subscription) popOldest() *Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Queue) == 0 {
+		return nil
+	}
+	lowest := s.Queue[len(s.Queue)-1].Priority
+	oldest := -1
+	for i, item := range s.Queue {
+		if item.Priority == lowest && (oldest < 0 || item.Offset < s.Queue[oldest].Offset) {
+			oldest = i
+		}
+	}
+	item := s.Queue[oldest]
+	s.Queue = append(s.Queue[:oldest:oldest], s.Queue[oldest+1:]...)
+	s.bytes -= len(item.Data)
+	return item
+}
+
+// Put the item back to the queue keeping the items of the same priority ordered by offset
+func (s *Subscription) insert(item *Item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := len(s.Queue)
+	for i > 0 && (s.Queue[i-1].Priority < item.Priority ||
+		(s.Queue[i-1].Priority == item.Priority && s.Queue[i-1].Offset > item.Offset)) {
+		i--
+	}
+	s.insertAt(i, item)
+}
+
+func (s *Subscription) insertAt(i int, item *Item) {
+	s.Queue = append(s.Queue, nil)
+	copy(s.Queue[i+1:], s.Queue[i:])
+	s.Queue[i] = item
+	s.bytes += len(item.Data)
+	s.notify()
+}
+
+// Remove the item with the given offset from the queue. Reports whether the item was queued
+func (s *Subscription) remove(offset int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, item := range s.Queue {
+		if item.Offset == offset {
+			s.Queue = append(s.Queue[:i:i], s.Queue[i+1:]...)
+			s.bytes -= len(item.Data)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the expired items from the head of the queue and return them
+func (s *Subscription) removeExpiredHead(now time.Time) []*Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(s.Queue) && s.Queue[i].expired(now) {
+		s.bytes -= len(s.Queue[i].Data)
+		i++
+	}
+	expired := s.Queue[:i:i]
+	s.Queue = s.Queue[i:]
+	return expired
+}
+
+// Remove every expired item from the queue and return them
+func (s *Subscription) removeExpired(now time.Time) []*Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []*Item
+	queue := s.Queue[:0:0]
+	for _, item := range s.Queue {
+		if item.expired(now) {
+			s.bytes -= len(item.Data)
+			expired = append(expired, item)
+		} else {
+			queue = append(queue, item)
+		}
+	}
+	s.Queue = queue
+	return expired
+}
+
+// Reports whether the item can be added to the queue without going over the limits. Zero limit means unlimited
+func (s *Subscription) fits(item *Item, maxItems int, maxBytes int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return (maxItems == 0 || len(s.Queue) < maxItems) && (maxBytes == 0 || s.bytes+len(item.Data) <= maxBytes)
+}
+
+// Reports whether the queue holds more than the limits allow. Zero limit means unlimited
+func (s *Subscription) overLimit(maxItems int, maxBytes int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return (maxItems > 0 && len(s.Queue) > maxItems) || (maxBytes > 0 && s.bytes > maxBytes)
+}
+
+// Returns the items queued or in flight in the order they are delivered. Items in flight are delivered again after a restart
+func (s *Subscription) pending() []*Item {
+	s.mu.RLock()
+	items := append([]*Item{}, s.Queue...)
+	s.mu.RUnlock()
+	for _, d := range s.inflight {
+		items = append(items, d.item)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Priority != items[j].Priority {
+			return items[i].Priority > items[j].Priority
+		}
+		return items[i].Offset < items[j].Offset
+	})
+	return items
+}
+
+// Replace the whole queue. Used for moving the subscription's cursor
+func (s *Subscription) reset(items []*Item) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Priority > items[j].Priority
+	})
+	s.mu.Lock()
+	s.Queue = items
+	s.bytes = 0
+	for _, item := range items {
+		s.bytes += len(item.Data)
+	}
+	s.notify()
+	s.mu.Unlock()
+}
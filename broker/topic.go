@@ -2,22 +2,250 @@ package broker
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/marcell7/MQ/protocol"
 )
 
 type Topic interface {
-	addItem(*Item) error                 // Adds an item to the topics's queue
-	addSubscription(string, *Subscriber) // Adds a subscription to the topic
-	deleteSubscription(string)           // Deletes a subscription
+	addItem(*Item) (*Item, error)                                   // Adds an item to the topics's queue. Returns the item published earlier with the same deduplication key instead if there is one
+	addSubscription(string, *Subscriber, subscriptionOptions) bool  // Adds a subscription (or a membership in a consumer group) to the topic. Reports whether a new subscription was created
+	deleteSubscription(string)                                      // Deletes a subscription
+	unsubscribe(string, bool) error                                 // Deletes a subscription discarding its queue, or once its queue is drained
+	popItem(string) (*Item, error)                                  // Takes the next item out of the subscription's queue
+	waitItem(string, time.Duration, <-chan struct{}) (*Item, error) // Takes the next item out of the subscription's queue waiting for one to arrive if it's empty
+	ack(string, int64) error                                        // Acknowledges that the delivered item was processed
+	nack(string, int64, string) error                               // Rejects the delivered item so that it is redelivered
+	credit(string, int) error                                       // Allows the broker to push more items to the streaming subscriber
+	seek(string, int64) (int64, error)                              // Moves the subscription's cursor to the given offset
 }
 
+const (
+	OffsetLatest   int64 = -1 // Seek past the last item in the topic - only items published from now on are received
+	OffsetEarliest int64 = -2 // Seek to the first item still kept in the topic
+)
+
+// Time a deduplication key is remembered for if the topic doesn't set its own window
+const DefaultDedupWindow = 2 * time.Minute
+
+// Number of items a topic keeps for seeking back if it doesn't set its own retention
+const DefaultRetentionItems = 10000
+
 // Implements Topic interface
 // Broker can have multiple topics. Each topic can have multiple subscriptions. Each subscription has a subscriber and queue that subscriber fetches items/messages from.
 type DefaultTopic struct {
 	id            string                   // id of the topic
 	name          string                   // name of the topic
 	mu            sync.RWMutex             // mutex for modifying the subscription map
-	Subscriptions map[string]*Subscription // Map storing all subscriptions for that topic. Map key is the subscriber's id
+	Subscriptions map[string]*Subscription // Map storing all subscriptions for that topic. Map key is the subscriber's id or the consumer group's id
+	members       map[string]string        // Maps subscriber's id to the id of the subscription it consumes from
+	items         []*Item                  // Ordered log of the items published to the topic
+	base          int64                    // Offset of the first item in items
+	log           *topicLog                // Write-ahead log of the topic. nil if the broker is not durable
+	config        TopicConfig              // Settings of the topic
+	deadLetter    *DefaultTopic            // Dead-letter topic of the topic. Nil if it has none
+	redriveOffset int64                    // Offset of the first item not yet moved back to its original topic (dead-letter topics only)
+	deleted       bool                     // Set once the topic is deleted from the broker
+	dropped       int64                    // Number of items dropped from full queues
+	expired       int64                    // Number of items discarded from queues because they expired before being delivered
+	sequence      int64                    // Sequence number of the last item published to the topic
+	dedup         map[string]*Item         // Items published within the dedup window by their deduplication key - {"<dedup_key>":"<item>"}
+	dedupOrder    []*Item                  // Items in dedup in the order they were published. Used for forgetting the keys once the window passes
+	scheduled     schedule                 // Items published with a delivery time that are not due yet
+	timer         *time.Timer              // Fires when the first scheduled item is due
+	retained      *Item                    // Latest retained item. Delivered to every new subscription
+	snapshot      map[int64]*Item          // Items of the snapshot being replayed by their offset. nil outside of replaying the log
+}
+
+var (
+	errNotSubscribed = errors.New("not subscribed to this topic")
+	errTopicDeleted  = errors.New("topic was deleted")
+	errTopicFull     = errors.New("topic is full")
+	errCancelled     = errors.New("connection was closed while waiting for an item")
+)
+
+// Snapshot of the state of a topic
+type TopicInfo struct {
+	Name          string      // name of the topic
+	Config        TopicConfig // Settings of the topic
+	FirstOffset   int64       // Offset of the first item kept in the topic
+	NextOffset    int64       // Offset the next published item gets
+	Subscriptions int         // Number of subscriptions. Consumer group counts as one
+	Subscribers   int         // Number of connected subscribers
+	Queued        int         // Number of items waiting in the queues of all subscriptions
+	Inflight      int         // Number of delivered items awaiting an acknowledgement
+	Dropped       int64       // Number of items dropped from full queues
+	Expired       int64       // Number of items discarded because they expired before being delivered
+	Scheduled     int         // Number of items waiting for their delivery time
+	Retained      bool        // Topic holds a retained item
+}
+
+// Settings of a topic
+type TopicConfig struct {
+	MaxDeliveries   int            // Number of deliveries after which an unacknowledged item is given up on. Unlimited if zero
+	DeadLetterTopic string         // Topic that receives items given up on. Items are discarded if empty
+	MaxItems        int            // Maximum number of items queued for a single subscription. Unlimited if zero
+	MaxBytes        int            // Maximum total size of the data of items queued for a single subscription. Unlimited if zero
+	Overflow        OverflowPolicy // What happens when a published item doesn't fit into a full queue
+	TTL             time.Duration  // Time after which items that were not delivered yet are discarded (counted from the delivery time of scheduled items). Items never expire if zero
+	DedupWindow     time.Duration  // Time a deduplication key is remembered for. DefaultDedupWindow is used if zero
+	Priorities      bool           // Items with higher priority are delivered first. Priorities set by publishers are ignored if false
+	RetentionItems  int            // Maximum number of items the topic keeps for seeking back. Items still queued for a subscription are delivered anyway. DefaultRetentionItems is used if zero
+	RetentionAge    time.Duration  // Time the topic keeps items for seeking back (counted from the publish time). Items are kept forever if zero
+}
+
+// Converts the settings received over the wire
+func topicConfigFromWire(cfg *protocol.TopicConfig) (TopicConfig, error) {
+	overflow, err := parseOverflowPolicy(cfg.Overflow)
+	if err != nil {
+		return TopicConfig{}, err
+	}
+	return TopicConfig{
+		MaxDeliveries:   cfg.MaxDeliveries,
+		DeadLetterTopic: cfg.DeadLetterTopic,
+		MaxItems:        cfg.MaxItems,
+		MaxBytes:        cfg.MaxBytes,
+		Overflow:        overflow,
+		TTL:             time.Duration(cfg.TTL) * time.Millisecond,
+		DedupWindow:     time.Duration(cfg.DedupWindow) * time.Millisecond,
+		Priorities:      cfg.Priorities,
+		RetentionItems:  cfg.RetentionItems,
+		RetentionAge:    time.Duration(cfg.RetentionAge) * time.Millisecond,
+	}, nil
+}
+
+// Converts the settings to be sent over the wire
+func (cfg TopicConfig) wire() protocol.TopicConfig {
+	return protocol.TopicConfig{
+		MaxDeliveries:   cfg.MaxDeliveries,
+		DeadLetterTopic: cfg.DeadLetterTopic,
+		MaxItems:        cfg.MaxItems,
+		MaxBytes:        cfg.MaxBytes,
+		Overflow:        cfg.Overflow.String(),
+		TTL:             cfg.TTL.Milliseconds(),
+		DedupWindow:     cfg.DedupWindow.Milliseconds(),
+		Priorities:      cfg.Priorities,
+		RetentionItems:  cfg.RetentionItems,
+		RetentionAge:    cfg.RetentionAge.Milliseconds(),
+	}
+}
+
+// OverflowPolicy decides what happens when a published item doesn't fit into a subscription's queue
+type OverflowPolicy int
+
+const (
+	OverflowReject     OverflowPolicy = iota // Publish is rejected and the item is not stored. Scheduled item that comes due into a full queue is dropped from it
+	OverflowDropOldest                       // Oldest queued items (of the lowest priority) are dropped to make room for the new one
+	OverflowDropNewest                       // New item is dropped from the full queue
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowReject:
+		return protocol.OverflowReject
+	case OverflowDropOldest:
+		return protocol.OverflowDropOldest
+	case OverflowDropNewest:
+		return protocol.OverflowDropNewest
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// Returns the overflow policy with the given name. Empty name is OverflowReject
+func parseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "", protocol.OverflowReject:
+		return OverflowReject, nil
+	case protocol.OverflowDropOldest:
+		return OverflowDropOldest, nil
+	case protocol.OverflowDropNewest:
+		return OverflowDropNewest, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// TopicOption configures a topic
+type TopicOption func(*TopicConfig)
+
+// Replaces all settings of the topic with cfg
+func WithTopicConfig(cfg TopicConfig) TopicOption {
+	return func(c *TopicConfig) {
+		*c = cfg
+	}
+}
+
+// Limits the number of items queued for each subscription
+func WithMaxItems(n int) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.MaxItems = n
+	}
+}
+
+// Limits the total size of the data of items queued for each subscription
+func WithMaxBytes(n int) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.MaxBytes = n
+	}
+}
+
+// Sets what happens when a published item doesn't fit into a full queue. Defaults to OverflowReject
+func WithOverflowPolicy(policy OverflowPolicy) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.Overflow = policy
+	}
+}
+
+// Discards items that were not delivered within ttl. Publishers can set a different TTL for each item
+func WithTTL(ttl time.Duration) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.TTL = ttl
+	}
+}
+
+// Drops items published with a deduplication key that was already used within the window
+func WithDedupWindow(window time.Duration) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.DedupWindow = window
+	}
+}
+
+// Delivers items with higher priority first. Items of the same priority are delivered in the order they were published
+func WithPriorities() TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.Priorities = true
+	}
+}
+
+// Keeps at most n items in the topic for seeking back
+func WithRetentionItems(n int) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.RetentionItems = n
+	}
+}
+
+// Keeps items in the topic for seeking back only until they are older than age
+func WithRetentionAge(age time.Duration) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.RetentionAge = age
+	}
+}
+
+// Gives up on items that were delivered (and not acknowledged) n times
+func WithMaxDeliveries(n int) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.MaxDeliveries = n
+	}
+}
+
+// Moves items given up on to the topic with the given name
+func WithDeadLetterTopic(name string) TopicOption {
+	return func(cfg *TopicConfig) {
+		cfg.DeadLetterTopic = name
+	}
 }
 
 // Constructor for the DefaultTopic struct
@@ -26,42 +254,938 @@ func newDefaultTopic(id string, name string) *DefaultTopic {
 		id:            id,
 		name:          name,
 		Subscriptions: make(map[string]*Subscription),
+		members:       make(map[string]string),
+		dedup:         make(map[string]*Item),
 	}
 }
 
-func (dt *DefaultTopic) addItem(item *Item) error {
-	dt.mu.RLock()
-	if len(dt.Subscriptions) == 0 {
-		return errors.New("no active subscriptions on this topic")
+func (dt *DefaultTopic) addItem(item *Item) (*Item, error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.deleted {
+		return nil, errTopicDeleted
+	}
+	// Publisher retrying a publish that already succeeded gets the original item back
+	if original := dt.duplicateOf(item, time.Now()); original != nil {
+		return original, nil
+	}
+	// Retained item is kept for the subscribers to come, so nobody has to be subscribed yet
+	if len(dt.Subscriptions) == 0 && !item.Retain {
+		return nil, errors.New("no active subscriptions on this topic")
+	}
+	if err := dt.storeItem(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Returns the item published within the dedup window with the same deduplication key as the item
+func (dt *DefaultTopic) duplicateOf(item *Item, now time.Time) *Item {
+	if item.DedupKey == "" {
+		return nil
 	}
-	dt.mu.RUnlock()
+	window := dt.config.DedupWindow
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	// Keys are forgotten in the order they were used
+	for len(dt.dedupOrder) > 0 {
+		oldest := dt.dedupOrder[0]
+		if now.Sub(time.UnixMilli(oldest.Timestamp)) < window {
+			break
+		}
+		if dt.dedup[oldest.DedupKey] == oldest {
+			delete(dt.dedup, oldest.DedupKey)
+		}
+		dt.dedupOrder[0] = nil
+		dt.dedupOrder = dt.dedupOrder[1:]
+	}
+	return dt.dedup[item.DedupKey]
+}
+
+// Remembers the deduplication key of the item
+func (dt *DefaultTopic) rememberKey(item *Item) {
+	if item.DedupKey == "" {
+		return
+	}
+	dt.dedup[item.DedupKey] = item
+	dt.dedupOrder = append(dt.dedupOrder, item)
+}
+
+// Adds an item to the topic even if nobody is subscribed to it. Used for moving items between topics
+func (dt *DefaultTopic) store(item *Item) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.storeItem(item)
+}
+
+func (dt *DefaultTopic) storeItem(item *Item) error {
+	if dt.deleted {
+		return errTopicDeleted
+	}
+	now := time.Now()
+	if !dt.config.Priorities {
+		item.Priority = 0
+	}
+	if item.Expires == 0 && dt.config.TTL > 0 {
+		item.Expires = item.visibleFrom(now).Add(dt.config.TTL).UnixMilli()
+	}
+	// Scheduled items are not queued yet, so they can't be rejected for not fitting. Limits apply once they are due
+	if dt.config.Overflow == OverflowReject && item.due(now) {
+		for _, subscription := range dt.Subscriptions {
+			if !subscription.draining && !dt.fits(subscription, item, now) {
+				return errTopicFull
+			}
+		}
+	}
+	if item.Id == "" {
+		item.Id = generateId()
+	}
+	if item.Timestamp == 0 {
+		item.Timestamp = now.UnixMilli()
+	}
+	item.Offset = dt.latestOffset()
+	item.Sequence = dt.sequence + 1
+	// Item has to be in the log before it is acknowledged to the publisher
+	if err := dt.persist(&logRecord{Type: recordItem, Item: item}); err != nil {
+		return err
+	}
+	dt.sequence = item.Sequence
+	dt.rememberKey(item)
+	if item.Retain {
+		dt.retained = item
+	}
+	queued := dt.appendItem(item, now)
+	dt.trim(now)
+	if !queued {
+		dt.armTimer()
+		return nil
+	}
+	for _, subscription := range dt.Subscriptions {
+		dt.enforceLimits(subscription, item, now)
+	}
+	return nil
+}
+
+// Drops the items that fall out of the topic's retention and advances base past them.
+// Queues of subscriptions, the schedule and the retained item hold on to the items they still need
+func (dt *DefaultTopic) trim(now time.Time) {
+	limit := dt.config.RetentionItems
+	if limit == 0 {
+		limit = DefaultRetentionItems
+	}
+	n := 0
+	for n < len(dt.items) {
+		item := dt.items[n]
+		overCount := len(dt.items)-n > limit
+		tooOld := dt.config.RetentionAge > 0 && now.Sub(time.UnixMilli(item.Timestamp)) >= dt.config.RetentionAge
+		if !overCount && !tooOld {
+			break
+		}
+		dt.items[n] = nil
+		n++
+	}
+	dt.items = dt.items[n:]
+	dt.base += int64(n)
+}
+
+// Reports whether the item fits into the subscription's queue. Expired items are discarded first to make room
+func (dt *DefaultTopic) fits(subscription *Subscription, item *Item, now time.Time) bool {
+	if subscription.fits(item, dt.config.MaxItems, dt.config.MaxBytes) {
+		return true
+	}
+	dt.discardExpired(subscription, subscription.removeExpired(now))
+	return subscription.fits(item, dt.config.MaxItems, dt.config.MaxBytes)
+}
+
+// Drops items from the subscription's queue that went over the limits after the item was added
+func (dt *DefaultTopic) enforceLimits(subscription *Subscription, item *Item, now time.Time) {
+	if !subscription.overLimit(dt.config.MaxItems, dt.config.MaxBytes) {
+		return
+	}
+	dt.discardExpired(subscription, subscription.removeExpired(now))
+	for subscription.overLimit(dt.config.MaxItems, dt.config.MaxBytes) {
+		var dropped *Item
+		switch dt.config.Overflow {
+		case OverflowDropNewest, OverflowReject:
+			// Scheduled item that came due can't be rejected any more, so it's dropped instead of the items already accepted
+			if subscription.remove(item.Offset) {
+				dropped = item
+			}
+		default:
+			// Most urgent items are kept when the topic has priorities
+			dropped = subscription.popOldest()
+		}
+		if dropped == nil {
+			return
+		}
+		dt.dropped++
+		dt.persist(&logRecord{Type: recordPop, Subscription: subscription.id, Offset: dropped.Offset})
+	}
+}
+
+// Counts the items discarded from the subscription's queue because they expired
+func (dt *DefaultTopic) discardExpired(subscription *Subscription, items []*Item) {
+	for _, item := range items {
+		dt.expired++
+		delete(subscription.attempts, item.Offset)
+		delete(subscription.reasons, item.Offset)
+		dt.persist(&logRecord{Type: recordPop, Subscription: subscription.id, Offset: item.Offset})
+	}
+}
+
+// Appends the item to the topic's log and to the queue of every subscription.
+// Item that is not due yet is scheduled instead. Reports whether the item was queued
+func (dt *DefaultTopic) appendItem(item *Item, now time.Time) bool {
+	dt.items = append(dt.items, item)
+	if !item.due(now) {
+		dt.schedule(item)
+		return false
+	}
+	dt.enqueue(item)
+	return true
+}
+
+// Adds the item to the queue of every subscription
+func (dt *DefaultTopic) enqueue(item *Item) {
 	// Each topic can have multiple subscriptions - one for each subscriber of that topic.
 	// Add item to every queue in these subscriptions
 	for _, subscription := range dt.Subscriptions {
+		if subscription.draining {
+			continue
+		}
 		subscription.addToQueue(item)
+		dt.dispatch(subscription)
 	}
+}
 
-	return nil
+// Pushes queued items to the streaming subscribers of the subscription
+func (dt *DefaultTopic) dispatch(subscription *Subscription) {
+	for {
+		dt.discardExpired(subscription, subscription.removeExpiredHead(time.Now()))
+		if len(subscription.Queue) == 0 {
+			dt.finishDrain(subscription)
+			return
+		}
+		id, subscriber := subscription.nextStreamer()
+		if subscriber == nil {
+			return
+		}
+		item, err := subscription.popOut()
+		if err != nil {
+			return
+		}
+		if subscription.ack {
+			dt.track(subscription, id, item).pushed = true
+		} else {
+			dt.persist(&logRecord{Type: recordPop, Subscription: subscription.id, Offset: item.Offset})
+		}
+		subscriber.push(dt.name, item)
+	}
 }
 
-func (dt *DefaultTopic) addSubscription(id string, subscriber *Subscriber) {
+// Subscribes the subscriber with the given id to the topic.
+// If group is set the subscriber joins the group's subscription and competes with other members for its items.
+// Reports whether a new subscription was created. Subscriber re-attaching to its own subscription, joining an existing group
+// or adopting a subscription restored from the log gets the items already queued in it
+func (dt *DefaultTopic) addSubscription(id string, subscriber *Subscriber, opts subscriptionOptions) bool {
 	dt.mu.Lock()
-	// Change to &Subscription{id:id, subscriber:subscriber}
+	defer dt.mu.Unlock()
+	group := opts.group
+	subscriptionId := id
+	if group != "" {
+		subscriptionId = groupSubscriptionId(group)
+	}
+	if current, ok := dt.members[id]; ok {
+		if current == subscriptionId {
+			subscription := dt.Subscriptions[subscriptionId]
+			if subscription.group == "" {
+				// Durable subscription restored from the log has no subscriber attached yet
+				subscription.subscriber = subscriber
+			}
+			subscription.draining = false
+			subscription.configure(opts)
+			subscription.setStreaming(id, opts.stream, opts.prefetch)
+			dt.dispatch(subscription)
+			return false
+		}
+		dt.leave(id)
+	}
+	dt.members[id] = subscriptionId
+
+	if group != "" {
+		subscription, ok := dt.Subscriptions[subscriptionId]
+		if !ok {
+			dt.persist(&logRecord{Type: recordSubscribe, Subscription: subscriptionId, Group: group})
+			subscription = newGroupSubscription(subscriptionId, group)
+			dt.Subscriptions[subscriptionId] = subscription
+			dt.deliverRetained(subscription)
+		}
+		subscription.draining = false
+		subscription.members[id] = subscriber
+		subscription.configure(opts)
+		subscription.setStreaming(id, opts.stream, opts.prefetch)
+		dt.dispatch(subscription)
+		return !ok
+	}
+	dt.persist(&logRecord{Type: recordSubscribe, Subscription: id})
 	subscription := newSubscription(id, subscriber)
+	subscription.configure(opts)
+	subscription.setStreaming(id, opts.stream, opts.prefetch)
 	dt.Subscriptions[id] = subscription
-	dt.mu.Unlock()
+	dt.deliverRetained(subscription)
+	dt.dispatch(subscription)
+	return true
+}
+
+// Queues the retained item for the new subscription
+func (dt *DefaultTopic) deliverRetained(subscription *Subscription) {
+	if r := dt.retained; r != nil && !r.scheduled && !r.expired(time.Now()) {
+		subscription.addToQueue(r)
+	}
+}
+
+// Drops the retained item. Items already queued for subscriptions are still delivered
+func (dt *DefaultTopic) clearRetained() error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.deleted {
+		return errTopicDeleted
+	}
+	if dt.retained == nil {
+		return nil
+	}
+	if err := dt.persist(&logRecord{Type: recordUnretain}); err != nil {
+		return err
+	}
+	dt.retained = nil
+	return nil
 }
 
 func (dt *DefaultTopic) deleteSubscription(id string) {
 	dt.mu.Lock()
-	delete(dt.Subscriptions, id)
-	dt.mu.Unlock()
+	defer dt.mu.Unlock()
+	dt.leave(id)
+}
+
+// Member of a consumer group leaves the group right away, the group's queue is left to the other members
+func (dt *DefaultTopic) unsubscribe(id string, drain bool) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, err := dt.subscriptionOf(id)
+	if err != nil {
+		return err
+	}
+	if drain && (subscription.group == "" || len(subscription.members) == 1) {
+		subscription.draining = true
+		dt.finishDrain(subscription)
+		return nil
+	}
+	dt.leave(id)
+	return nil
+}
+
+// Deletes the draining subscription once nothing is left in its queue or in flight
+func (dt *DefaultTopic) finishDrain(subscription *Subscription) {
+	if !subscription.draining || len(subscription.Queue) > 0 || len(subscription.inflight) > 0 {
+		return
+	}
+	ids := []string{subscription.id}
+	if subscription.group != "" {
+		ids = ids[:0]
+		for id := range subscription.members {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		dt.leave(id)
+	}
+}
+
+// Removes the subscriber from its subscription. Group subscription is deleted once its last member leaves
+func (dt *DefaultTopic) leave(id string) {
+	subscriptionId, ok := dt.members[id]
+	if !ok {
+		return
+	}
+	delete(dt.members, id)
+	subscription, ok := dt.Subscriptions[subscriptionId]
+	if !ok {
+		return
+	}
+	// Items the subscriber did not acknowledge are redelivered to other members
+	for _, d := range subscription.inflight {
+		if d.subscriber == id {
+			dt.requeue(subscription, d)
+		}
+	}
+	subscription.setStreaming(id, false, 0)
+	if subscription.group != "" {
+		delete(subscription.members, id)
+		dt.dispatch(subscription)
+		if len(subscription.members) > 0 {
+			return
+		}
+	}
+	dt.persist(&logRecord{Type: recordUnsubscribe, Subscription: subscriptionId})
+	delete(dt.Subscriptions, subscriptionId)
+}
+
+// Returns the subscription the subscriber with the given id consumes from
+func (dt *DefaultTopic) subscriptionOf(id string) (*Subscription, error) {
+	if dt.deleted {
+		return nil, errTopicDeleted
+	}
+	subscription, ok := dt.Subscriptions[dt.members[id]]
+	if !ok {
+		return nil, errNotSubscribed
+	}
+	return subscription, nil
+}
+
+func (dt *DefaultTopic) popItem(id string) (*Item, error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	item, _, err := dt.pop(id)
+	return item, err
+}
+
+// Parks until an item arrives to the subscription or the timeout expires. Returns errEmptyQueue on timeout
+// and errCancelled once cancel is closed, so that a dropped connection doesn't take items it can't deliver
+func (dt *DefaultTopic) waitItem(id string, timeout time.Duration, cancel <-chan struct{}) (*Item, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-cancel:
+			return nil, errCancelled
+		default:
+		}
+		item, changed, err := dt.popOrWatch(id)
+		if err != errEmptyQueue {
+			return item, err
+		}
+		select {
+		case <-changed:
+			// Item might have been taken by someone else in the meantime, so try again
+		case <-cancel:
+			return nil, errCancelled
+		case <-timer.C:
+			return nil, errEmptyQueue
+		}
+	}
+}
+
+// Takes the next item out of the subscription's queue. If the queue is empty returns errEmptyQueue
+// together with a channel that is closed the next time items are added to it
+func (dt *DefaultTopic) popOrWatch(id string) (*Item, <-chan struct{}, error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	item, subscription, err := dt.pop(id)
+	if err == errEmptyQueue {
+		return nil, subscription.changed(), err
+	}
+	return item, nil, err
+}
+
+// Takes the next item out of the subscriber's subscription. Returns the subscription as well
+func (dt *DefaultTopic) pop(id string) (*Item, *Subscription, error) {
+	subscription, err := dt.subscriptionOf(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	dt.discardExpired(subscription, subscription.removeExpiredHead(time.Now()))
+	item, err := subscription.popOut()
+	if err != nil {
+		return nil, subscription, err
+	}
+	if subscription.ack {
+		// Item stays in the log until it's acknowledged
+		dt.track(subscription, id, item)
+		return item, subscription, nil
+	}
+	if err := dt.persist(&logRecord{Type: recordPop, Subscription: subscription.id, Offset: item.Offset}); err != nil {
+		return nil, subscription, err
+	}
+	dt.finishDrain(subscription)
+	return item, subscription, nil
+}
+
+// Keeps the delivered item in flight until it's acknowledged or the ack timeout expires
+func (dt *DefaultTopic) track(subscription *Subscription, subscriberId string, item *Item) *delivery {
+	subscription.attempts[item.Offset]++
+	d := &delivery{item: item, subscriber: subscriberId}
+	d.timer = time.AfterFunc(subscription.ackTimeout, func() {
+		dt.mu.Lock()
+		defer dt.mu.Unlock()
+		if subscription.inflight[item.Offset] == d {
+			dt.requeue(subscription, d)
+		}
+	})
+	subscription.inflight[item.Offset] = d
+	return d
+}
+
+// Removes the item from the items in flight. Pushed item gives the credit it took back to the subscriber
+func (dt *DefaultTopic) settle(subscription *Subscription, d *delivery) {
+	d.timer.Stop()
+	delete(subscription.inflight, d.item.Offset)
+	if d.pushed {
+		subscription.grant(d.subscriber, 1)
+	}
+}
+
+// Puts the delivered item back to the subscription's queue so that it is delivered again.
+// Item that already reached the maximum number of deliveries is given up on instead
+func (dt *DefaultTopic) requeue(subscription *Subscription, d *delivery) {
+	dt.settle(subscription, d)
+	if dt.config.MaxDeliveries > 0 && subscription.attempts[d.item.Offset] >= dt.config.MaxDeliveries {
+		dt.giveUp(subscription, d.item)
+	} else {
+		subscription.insert(d.item)
+	}
+	dt.dispatch(subscription)
+}
+
+// Moves the item out of the subscription and into the dead-letter topic (if there is one)
+func (dt *DefaultTopic) giveUp(subscription *Subscription, item *Item) {
+	offset := item.Offset
+	if dt.deadLetter != nil {
+		deadItem := item.clone()
+		deadItem.DeadLetter = &DeadLetter{
+			Topic:    dt.name,
+			Offset:   offset,
+			Attempts: subscription.attempts[offset],
+			Reason:   subscription.reasons[offset],
+			Priority: item.Priority,
+		}
+		if err := dt.deadLetter.store(deadItem); err != nil {
+			// Rather deliver the item again than lose it
+			log.Printf("Error moving item %d of topic %s to the dead-letter topic: %s", offset, dt.name, err)
+			subscription.insert(item)
+			return
+		}
+	}
+	delete(subscription.attempts, offset)
+	delete(subscription.reasons, offset)
+	dt.persist(&logRecord{Type: recordPop, Subscription: subscription.id, Offset: offset})
+}
+
+// Returns the item delivered to the subscriber that still waits for an acknowledgement
+func (dt *DefaultTopic) inflightItem(id string, offset int64) (*Subscription, *delivery, error) {
+	subscription, err := dt.subscriptionOf(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, ok := subscription.inflight[offset]
+	if !ok || d.subscriber != id {
+		return nil, nil, errors.New("item is not awaiting an acknowledgement")
+	}
+	return subscription, d, nil
+}
+
+func (dt *DefaultTopic) ack(id string, offset int64) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, d, err := dt.inflightItem(id, offset)
+	if err != nil {
+		return err
+	}
+	dt.settle(subscription, d)
+	delete(subscription.attempts, offset)
+	delete(subscription.reasons, offset)
+	if err := dt.persist(&logRecord{Type: recordPop, Subscription: subscription.id, Offset: offset}); err != nil {
+		return err
+	}
+	// Dispatching also deletes the subscription if it was drained
+	dt.dispatch(subscription)
+	return nil
+}
+
+func (dt *DefaultTopic) credit(id string, n int) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, err := dt.subscriptionOf(id)
+	if err != nil {
+		return err
+	}
+	subscription.grant(id, n)
+	dt.dispatch(subscription)
+	return nil
+}
+
+func (dt *DefaultTopic) nack(id string, offset int64, reason string) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, d, err := dt.inflightItem(id, offset)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		subscription.reasons[offset] = reason
+	}
+	dt.requeue(subscription, d)
+	return nil
+}
+
+// Moves the subscription's cursor so that the next item received is the one at offset.
+// Offsets outside of the topic's log are clamped to its bounds. Returns the resulting offset
+func (dt *DefaultTopic) seek(id string, offset int64) (int64, error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	subscription, err := dt.subscriptionOf(id)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case offset == OffsetLatest || offset > dt.latestOffset():
+		offset = dt.latestOffset()
+	case offset == OffsetEarliest || offset < dt.base:
+		offset = dt.base
+	}
+	if err := dt.persist(&logRecord{Type: recordSeek, Subscription: subscription.id, Offset: offset}); err != nil {
+		return 0, err
+	}
+	// Items in flight are replaced by the new position of the cursor
+	for _, d := range subscription.inflight {
+		dt.settle(subscription, d)
+	}
+	subscription.attempts = make(map[int64]int)
+	subscription.reasons = make(map[int64]string)
+	subscription.reset(dt.itemsFrom(offset))
+	dt.dispatch(subscription)
+	return offset, nil
+}
+
+func (dt *DefaultTopic) info() TopicInfo {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	now := time.Now()
+	for _, subscription := range dt.Subscriptions {
+		dt.discardExpired(subscription, subscription.removeExpired(now))
+	}
+	dt.trim(now)
+	info := TopicInfo{
+		Name:          dt.name,
+		Config:        dt.config,
+		FirstOffset:   dt.base,
+		NextOffset:    dt.latestOffset(),
+		Subscriptions: len(dt.Subscriptions),
+		Subscribers:   len(dt.members),
+		Dropped:       dt.dropped,
+		Expired:       dt.expired,
+		Scheduled:     len(dt.scheduled),
+		Retained:      dt.retained != nil,
+	}
+	for _, subscription := range dt.Subscriptions {
+		info.Queued += len(subscription.Queue)
+		info.Inflight += len(subscription.inflight)
+	}
+	return info
+}
+
+// Drops every subscription and item of the topic. Subscribers waiting for an item are woken up and get errTopicDeleted
+func (dt *DefaultTopic) close() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.deleted = true
+	dt.armTimer()
+	dt.scheduled = nil
+	for _, subscription := range dt.Subscriptions {
+		for _, d := range subscription.inflight {
+			d.timer.Stop()
+		}
+		subscription.reset(nil)
+	}
+	dt.Subscriptions = make(map[string]*Subscription)
+	dt.members = make(map[string]string)
+	dt.items = nil
+	dt.dedup = make(map[string]*Item)
+	dt.dedupOrder = nil
+	dt.retained = nil
+}
+
+// Returns up to max items (all if max <= 0) that were not yet moved back from the dead-letter topic
+func (dt *DefaultTopic) redriveItems(max int) []*Item {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+	items := dt.itemsFrom(dt.redriveOffset)
+	if max > 0 && len(items) > max {
+		items = items[:max]
+	}
+	return items
+}
+
+// Marks every item before offset as moved back from the dead-letter topic
+func (dt *DefaultTopic) advanceRedrive(offset int64) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if err := dt.persist(&logRecord{Type: recordRedrive, Offset: offset}); err != nil {
+		return err
+	}
+	dt.redriveOffset = offset
+	return nil
+}
+
+// Offset that the next published item gets
+func (dt *DefaultTopic) latestOffset() int64 {
+	return dt.base + int64(len(dt.items))
+}
+
+// Returns a copy of the topic's log starting at offset. Scheduled items are left out until they are due
+func (dt *DefaultTopic) itemsFrom(offset int64) []*Item {
+	if offset < dt.base {
+		offset = dt.base
+	}
+	if offset >= dt.latestOffset() {
+		return nil
+	}
+	items := make([]*Item, 0, dt.latestOffset()-offset)
+	for _, item := range dt.items[offset-dt.base:] {
+		if !item.scheduled {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Writes the record to the topic's log if the topic is durable
+func (dt *DefaultTopic) persist(rec *logRecord) error {
+	if dt.log == nil {
+		return nil
+	}
+	if err := dt.log.append(rec); err != nil {
+		return err
+	}
+	// Snapshot has to include the change the record belongs to, so it's taken once the topic is unlocked
+	if dt.log.startCompaction() {
+		go dt.compact()
+	}
+	return nil
+}
+
+// Rewrites the topic's log as a snapshot of the topic's current state. Records of consumed items,
+// of items that fell out of the retention and of deleted subscriptions are left behind
+func (dt *DefaultTopic) compact() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.deleted {
+		return
+	}
+	if err := dt.log.compact(dt.snapshotRecords(time.Now())); err != nil && !errors.Is(err, errLogClosed) {
+		log.Printf("Error compacting the log of topic %s: %s", dt.name, err)
+	}
+}
+
+// Returns the records that rebuild the current state of the topic when replayed
+func (dt *DefaultTopic) snapshotRecords(now time.Time) []*logRecord {
+	dt.trim(now)
+	config := dt.config
+	records := []*logRecord{
+		{Type: recordSnapshot, Offset: dt.base, Sequence: dt.sequence},
+		{Type: recordConfig, Config: &config},
+	}
+	// Items trimmed from the topic are written only if something still holds on to them
+	held := make(map[int64]*Item)
+	hold := func(item *Item) {
+		if item.Offset < dt.base {
+			held[item.Offset] = item
+		}
+	}
+	queues := make(map[string][]*Item, len(dt.Subscriptions))
+	for id, subscription := range dt.Subscriptions {
+		queues[id] = subscription.pending()
+		for _, item := range queues[id] {
+			hold(item)
+		}
+	}
+	for _, item := range dt.scheduled {
+		hold(item)
+	}
+	for _, item := range dt.dedupOrder {
+		hold(item)
+	}
+	if dt.retained != nil {
+		hold(dt.retained)
+	}
+	items := make([]*Item, 0, len(held)+len(dt.items))
+	for _, item := range held {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Offset < items[j].Offset
+	})
+	for _, item := range append(items, dt.items...) {
+		records = append(records, &logRecord{Type: recordItem, Item: item})
+		if !item.scheduled && !item.due(time.UnixMilli(item.Timestamp)) {
+			// Delayed item that already came due isn't scheduled again
+			records = append(records, &logRecord{Type: recordDue, Offset: item.Offset})
+		}
+	}
+	if dt.retained == nil {
+		records = append(records, &logRecord{Type: recordUnretain})
+	}
+	if dt.redriveOffset > 0 {
+		records = append(records, &logRecord{Type: recordRedrive, Offset: dt.redriveOffset})
+	}
+	for id, subscription := range dt.Subscriptions {
+		offsets := make([]int64, 0, len(queues[id]))
+		for _, item := range queues[id] {
+			offsets = append(offsets, item.Offset)
+		}
+		records = append(records,
+			&logRecord{Type: recordSubscribe, Subscription: id, Group: subscription.group},
+			&logRecord{Type: recordQueue, Subscription: id, Offsets: offsets},
+		)
+	}
+	return records
+}
+
+// Rebuilds the subscriptions and their queues from a record read from the log.
+// Only subscriptions of durable subscribers and consumer groups are restored. They stay detached until their subscribers come back.
+func (dt *DefaultTopic) replay(rec *logRecord) error {
+	switch rec.Type {
+	case recordItem:
+		if rec.Item.Sequence > dt.sequence {
+			dt.sequence = rec.Item.Sequence
+		}
+		dt.rememberKey(rec.Item)
+		if rec.Item.Retain {
+			dt.retained = rec.Item
+		}
+		if dt.snapshot != nil {
+			dt.snapshot[rec.Item.Offset] = rec.Item
+		}
+		if rec.Item.Offset < dt.base {
+			// Item trimmed from the topic that is still queued, scheduled or retained (snapshots only)
+			if !rec.Item.due(time.UnixMilli(rec.Item.Timestamp)) {
+				dt.schedule(rec.Item)
+			}
+			break
+		}
+		// Delayed item stays scheduled until its recordDue, so it's queued to the subscriptions that existed then
+		dt.appendItem(rec.Item, time.UnixMilli(rec.Item.Timestamp))
+	case recordDue:
+		if item := dt.unschedule(rec.Offset); item != nil {
+			dt.enqueue(item)
+		}
+	case recordSubscribe:
+		if rec.Group == "" && !isDurable(rec.Subscription) {
+			// Subscriber that isn't durable can't come back for its subscription once its connection is gone
+			break
+		}
+		subscription := newSubscription(rec.Subscription, nil)
+		if rec.Group != "" {
+			subscription = newGroupSubscription(rec.Subscription, rec.Group)
+		}
+		// New subscriptions got the retained item at the time they were created
+		dt.deliverRetained(subscription)
+		dt.Subscriptions[rec.Subscription] = subscription
+		if rec.Group == "" && isDurable(rec.Subscription) {
+			// Durable subscriber finds its subscription by its id when it reconnects
+			dt.members[rec.Subscription] = rec.Subscription
+		}
+	case recordPop:
+		if subscription, ok := dt.Subscriptions[rec.Subscription]; ok {
+			subscription.remove(rec.Offset)
+		}
+	case recordSeek:
+		if subscription, ok := dt.Subscriptions[rec.Subscription]; ok {
+			subscription.reset(dt.itemsFrom(rec.Offset))
+		}
+	case recordRedrive:
+		dt.redriveOffset = rec.Offset
+	case recordConfig:
+		// Dead-letter topic is resolved by the broker once every topic is restored
+		dt.config = *rec.Config
+	case recordUnsubscribe:
+		delete(dt.Subscriptions, rec.Subscription)
+		delete(dt.members, rec.Subscription)
+	case recordUnretain:
+		dt.retained = nil
+	case recordSnapshot:
+		// Snapshot holds the whole state of the topic, so everything replayed before it is dropped
+		dt.Subscriptions = make(map[string]*Subscription)
+		dt.members = make(map[string]string)
+		dt.items = nil
+		dt.base = rec.Offset
+		dt.sequence = rec.Sequence
+		dt.redriveOffset = 0
+		dt.dedup = make(map[string]*Item)
+		dt.dedupOrder = nil
+		dt.scheduled = nil
+		dt.retained = nil
+		dt.snapshot = make(map[int64]*Item)
+	case recordQueue:
+		if subscription, ok := dt.Subscriptions[rec.Subscription]; ok {
+			items := make([]*Item, 0, len(rec.Offsets))
+			for _, offset := range rec.Offsets {
+				if item, ok := dt.snapshot[offset]; ok {
+					items = append(items, item)
+				}
+			}
+			subscription.reset(items)
+		}
+	default:
+		return errors.New("unknown record type in the topic log")
+	}
+	return nil
 }
 
 // Item struct that represents the data that is stored in the topic's queue
 type Item struct {
-	Id   string // id of the publish message
-	Data string // User-provided data
+	Id         string            // Unique id assigned by the broker. Ids sort in the order the items were published
+	Data       string            // User-provided data
+	Headers    map[string]string // User-provided metadata (e.g. correlation id, content type)
+	Offset     int64             // Position of the item in the topic's log
+	Timestamp  int64             // Time (unix milliseconds) the item was published
+	Sequence   int64             // Number of the item among the items published to the topic, starting at 1
+	Expires    int64             // Time (unix milliseconds) after which the item is discarded if it was not delivered yet. Never if zero
+	DedupKey   string            // Publisher-provided key. Items published with the same key within the topic's dedup window are dropped
+	ReplyTo    string            // Inbox (or topic) the subscriber should send the reply to
+	DeliverAt  int64             // Time (unix milliseconds) before which the item is not delivered. Delivered right away if zero
+	Priority   int               // Items with higher priority are delivered first. Always zero in topics without priorities
+	Retain     bool              // Topic keeps the item and delivers it to every new subscription until another retained item replaces it
+	scheduled  bool              // Set while the item waits for its delivery time
+	DeadLetter *DeadLetter       // Why the item ended up in a dead-letter topic. nil for regular items
+}
+
+// Returns a copy of the item's data to be stored in another topic.
+// Expiry, schedule, dedup key and retain flag belong to the original publish and are not copied
+func (i *Item) clone() *Item {
+	c := newItem(i.Id, i.Data)
+	c.Headers = i.Headers
+	c.Timestamp = i.Timestamp
+	c.Priority = i.Priority
+	c.ReplyTo = i.ReplyTo
+	return c
+}
+
+// Reports whether the item's delivery time has come
+func (i *Item) due(now time.Time) bool {
+	return i.DeliverAt <= now.UnixMilli()
+}
+
+// Returns the time the item becomes visible to subscribers
+func (i *Item) visibleFrom(now time.Time) time.Time {
+	if i.due(now) {
+		return now
+	}
+	return time.UnixMilli(i.DeliverAt)
+}
+
+// Reports whether the item should no longer be delivered
+func (i *Item) expired(now time.Time) bool {
+	return i.Expires > 0 && now.UnixMilli() >= i.Expires
+}
+
+// Describes an item that was moved to a dead-letter topic
+type DeadLetter struct {
+	Topic    string // Topic the item was originally published to
+	Offset   int64  // Offset of the item in the original topic
+	Attempts int    // Number of times the item was delivered
+	Reason   string // Reason given by the subscriber when it last rejected the item
+	Priority int    // Priority of the item in the original topic. Kept even if the dead-letter topic ignores priorities
 }
 
 // Constructor for the Item struct
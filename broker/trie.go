@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/marcell7/MQ/protocol"
+)
+
+// Index of topics and wildcard subscriptions by the levels of their names.
+// New topics are matched against the patterns of wildcard subscriptions and patterns against the existing topics
+type topicTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children  map[string]*trieNode             // child nodes keyed by the next level of the name
+	topic     *DefaultTopic                    // topic whose name ends at this node
+	wildcards map[string]*wildcardSubscription // wildcard subscriptions whose pattern ends at this node - {"<subscriber_id>":"<wildcardSubscription>"}
+}
+
+// Subscription to every topic matching a pattern, including the ones created later
+type wildcardSubscription struct {
+	pattern    string              // pattern the topics have to match
+	subscriber *Subscriber         // subscriber
+	opts       subscriptionOptions // settings applied to the subscription of every matching topic
+}
+
+// Constructor for the topicTrie struct
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTrieNode()}
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children:  make(map[string]*trieNode),
+		wildcards: make(map[string]*wildcardSubscription),
+	}
+}
+
+// Returns the node the name ends at creating the missing nodes on the way
+func (t *topicTrie) node(name string) *trieNode {
+	node := t.root
+	for _, level := range strings.Split(name, protocol.TopicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTrieNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	return node
+}
+
+func (t *topicTrie) addTopic(topic *DefaultTopic) {
+	t.node(topic.name).topic = topic
+}
+
+func (t *topicTrie) removeTopic(name string) {
+	t.remove(name, func(node *trieNode) {
+		node.topic = nil
+	})
+}
+
+func (t *topicTrie) addWildcard(ws *wildcardSubscription) {
+	t.node(ws.pattern).wildcards[ws.subscriber.id] = ws
+}
+
+// Removes the wildcard subscription of the subscriber to the pattern. Reports whether there was one
+func (t *topicTrie) removeWildcard(pattern string, id string) bool {
+	found := false
+	t.remove(pattern, func(node *trieNode) {
+		_, found = node.wildcards[id]
+		delete(node.wildcards, id)
+	})
+	return found
+}
+
+// Removes every wildcard subscription of the subscriber with the given id
+func (t *topicTrie) removeSubscriber(id string) {
+	var walk func(node *trieNode)
+	walk = func(node *trieNode) {
+		delete(node.wildcards, id)
+		for level, child := range node.children {
+			walk(child)
+			if child.empty() {
+				delete(node.children, level)
+			}
+		}
+	}
+	walk(t.root)
+}
+
+// Applies fn to the node the name ends at and prunes the nodes left empty
+func (t *topicTrie) remove(name string, fn func(*trieNode)) {
+	levels := strings.Split(name, protocol.TopicSeparator)
+	path := []*trieNode{t.root}
+	for _, level := range levels {
+		child, ok := path[len(path)-1].children[level]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+	}
+	fn(path[len(path)-1])
+	for i := len(levels) - 1; i >= 0; i-- {
+		if !path[i+1].empty() {
+			return
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+func (n *trieNode) empty() bool {
+	return n.topic == nil && len(n.wildcards) == 0 && len(n.children) == 0
+}
+
+// Returns every topic matching the pattern
+func (t *topicTrie) matchTopics(pattern string) []*DefaultTopic {
+	var topics []*DefaultTopic
+	var walk func(node *trieNode, levels []string)
+	walk = func(node *trieNode, levels []string) {
+		if len(levels) == 0 {
+			if node.topic != nil {
+				topics = append(topics, node.topic)
+			}
+			return
+		}
+		switch levels[0] {
+		case protocol.WildcardOne:
+			for _, child := range node.children {
+				walk(child, levels[1:])
+			}
+		case protocol.WildcardMany:
+			for _, child := range node.children {
+				child.collectTopics(&topics)
+			}
+		default:
+			if child, ok := node.children[levels[0]]; ok {
+				walk(child, levels[1:])
+			}
+		}
+	}
+	walk(t.root, strings.Split(pattern, protocol.TopicSeparator))
+	return topics
+}
+
+// Appends every topic in the subtree of the node
+func (n *trieNode) collectTopics(topics *[]*DefaultTopic) {
+	if n.topic != nil {
+		*topics = append(*topics, n.topic)
+	}
+	for _, child := range n.children {
+		child.collectTopics(topics)
+	}
+}
+
+// Returns every wildcard subscription whose pattern matches the topic
+func (t *topicTrie) matchWildcards(topic string) []*wildcardSubscription {
+	var matches []*wildcardSubscription
+	var walk func(node *trieNode, levels []string)
+	walk = func(node *trieNode, levels []string) {
+		if len(levels) == 0 {
+			for _, ws := range node.wildcards {
+				matches = append(matches, ws)
+			}
+			return
+		}
+		if many, ok := node.children[protocol.WildcardMany]; ok {
+			for _, ws := range many.wildcards {
+				matches = append(matches, ws)
+			}
+		}
+		if one, ok := node.children[protocol.WildcardOne]; ok {
+			walk(one, levels[1:])
+		}
+		if child, ok := node.children[levels[0]]; ok {
+			walk(child, levels[1:])
+		}
+	}
+	walk(t.root, strings.Split(topic, protocol.TopicSeparator))
+	return matches
+}
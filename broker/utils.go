@@ -2,10 +2,50 @@ package broker
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
-// Basic id generator
+const defaultAckTimeout = 30 * time.Second // Time after which an unacknowledged item is redelivered
+
+var lastId int64 // Last value handed out by generateId
+
+// Generates a unique id that sorts in the order the ids were generated. The id is the current time in nanoseconds,
+// bumped when ids are generated faster than the clock advances, encoded as fixed width hex
 func generateId() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	for {
+		last := atomic.LoadInt64(&lastId)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastId, last, next) {
+			return fmt.Sprintf("%016x", next)
+		}
+	}
+}
+
+// Waits until one of the channels is closed or the timeout expires. Reports whether a channel was closed
+func waitAny(channels []<-chan struct{}, timeout <-chan time.Time) bool {
+	woken := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	for _, ch := range channels {
+		go func(ch <-chan struct{}) {
+			select {
+			case <-ch:
+				select {
+				case woken <- struct{}{}:
+				default:
+				}
+			case <-done:
+			}
+		}(ch)
+	}
+	select {
+	case <-woken:
+		return true
+	case <-timeout:
+		return false
+	}
 }
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/marcell7/MQ/protocol"
+)
+
+const (
+	defaultBatchSize  = 100                  // Maximum number of asynchronously published messages written at once
+	defaultBatchBytes = 1 << 20              // Maximum size of the batch of asynchronously published messages in bytes
+	defaultLinger     = 5 * time.Millisecond // Time a batch waits for more messages before it's written
+)
+
+// Option configures a publisher, a subscriber or a client
+type Option func(*options)
+
+type options struct {
+	protocol   protocol.Protocol // Protocol spoken with the broker
+	name       string            // Durable name the subscriber registers with
+	batchSize  int               // Maximum number of asynchronously published messages written at once
+	batchBytes int               // Maximum size of the batch of asynchronously published messages in bytes
+	linger     time.Duration     // Time a batch waits for more messages before it's written
+}
+
+// Client speaks the provided protocol with the broker. Text protocol (protocol.DefaultProtocol) is used by default
+func WithProtocol(p protocol.Protocol) Option {
+	return func(o *options) {
+		o.protocol = p
+	}
+}
+
+// Client speaks the length-prefixed binary protocol with the broker. Messages can contain arbitrary bytes
+func WithBinaryProtocol() Option {
+	return WithProtocol(new(protocol.BinaryProtocol))
+}
+
+// Subscriber registers with a durable name. Its subscriptions and the messages queued in them survive disconnects
+// and are re-attached when a subscriber (or a client) with the same name connects again. Ignored by publishers
+func WithDurableName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Messages published with PublishAsync are written to the broker in batches of up to n messages. Defaults to 100
+func WithBatchSize(n int) Option {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// Batch of messages published with PublishAsync is written once it grows to n bytes. Defaults to 1 MiB
+func WithBatchBytes(n int) Option {
+	return func(o *options) {
+		o.batchBytes = n
+	}
+}
+
+// Batch that isn't full is written once the linger time passes after the first message was added to it.
+// Defaults to 5ms. Every message is written right away if zero
+func WithLinger(linger time.Duration) Option {
+	return func(o *options) {
+		o.linger = linger
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		protocol:   new(protocol.DefaultProtocol),
+		batchSize:  defaultBatchSize,
+		batchBytes: defaultBatchBytes,
+		linger:     defaultLinger,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Connects to the broker and tells it which protocol the client speaks
+func dial(addr string, p protocol.Protocol) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if preamble := protocol.Preamble(p); preamble != nil {
+		if _, err := conn.Write(preamble); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Publishes and subscribes over a single connection to the broker. Has the methods of both DefaultPublisher and DefaultSubscriber
+type DefaultClient struct {
+	*session
+	*DefaultPublisher
+	*DefaultSubscriber
+}
+
+// Constructor for the DefaultClient struct
+func NewClient(addr string, opts ...Option) (*DefaultClient, error) {
+	s := newSession(addr, opts)
+	c := &DefaultClient{
+		session:           s,
+		DefaultPublisher:  &DefaultPublisher{session: s},
+		DefaultSubscriber: &DefaultSubscriber{session: s},
+	}
+	if err := c.open(c.register); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Registers the client both as a publisher and as a subscriber
+func (c *DefaultClient) register() error {
+	return c.request(protocol.CMD_REG, c.registration())
+}
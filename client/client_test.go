@@ -2,10 +2,13 @@ package client
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/marcell7/MQ/broker"
+	"github.com/marcell7/MQ/protocol"
 )
 
 func TestPublisher(t *testing.T) {
@@ -146,3 +149,1037 @@ func TestReceiveFromEmptyQueue(t *testing.T) {
 		t.Errorf("Expected error got none")
 	}
 }
+
+func TestSubscriberSeek(t *testing.T) {
+	b := broker.New("127.0.0.1:3200")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3200")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3200")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, message := range []string{"first", "second", "third"} {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"%s"}`, message)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = subscriber.Receive("default"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// Replay the whole topic
+	if err = subscriber.SeekToEarliest("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Offset != 0 || msg.Payload.Message != "first" {
+		t.Errorf("Expected to receive first at offset 0 got %s at offset %d", msg.Payload.Message, msg.Payload.Offset)
+	}
+
+	// Replay from a chosen offset
+	if err = subscriber.Seek("default", 2); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err = subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Offset != 2 || msg.Payload.Message != "third" {
+		t.Errorf("Expected to receive third at offset 2 got %s at offset %d", msg.Payload.Message, msg.Payload.Offset)
+	}
+
+	if err = subscriber.SeekToEarliest("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.SeekToLatest("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err = subscriber.Receive("default"); err == nil {
+		t.Errorf("Expected error after seeking to the latest offset got none")
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	b := broker.New("127.0.0.1:3201")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	var workers []*DefaultSubscriber
+	for i := 0; i < 2; i++ {
+		worker, err := NewSubscriber("127.0.0.1:3201")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		defer worker.Close()
+		if err = worker.SubscribeGroup("default", "workers"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		workers = append(workers, worker)
+	}
+	subscriber, err := NewSubscriber("127.0.0.1:3201")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	publisher, err := NewPublisher("127.0.0.1:3201")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	if len(b.Topics["default"].Subscriptions) != 2 {
+		t.Fatalf("Expected 2 subscriptions (one group and one subscriber) got %d", len(b.Topics["default"].Subscriptions))
+	}
+
+	// Members of the group share the items
+	received := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		msg, err := workers[i%2].Receive("default")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if received[msg.Payload.Message] {
+			t.Errorf("Message %s was delivered to the group more than once", msg.Payload.Message)
+		}
+		received[msg.Payload.Message] = true
+	}
+	if _, err = workers[0].Receive("default"); err == nil {
+		t.Errorf("Expected the group's queue to be empty")
+	}
+
+	// Subscriber outside of the group still gets its own copy of every item
+	for i := 0; i < 4; i++ {
+		if _, err = subscriber.Receive("default"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+}
+
+func TestAckRedelivery(t *testing.T) {
+	b := broker.New("127.0.0.1:3202")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3202")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.SubscribeWith("default", SubscribeOptions{Ack: true, AckTimeout: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3202")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, message := range []string{"first", "second"} {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"%s"}`, message)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// first is left unacknowledged, second is rejected
+	if _, err = subscriber.Receive("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Nack(msg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err = subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "second" {
+		t.Errorf("Expected rejected message second to be redelivered got %s", msg.Payload.Message)
+	}
+	if err = subscriber.Ack(msg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// first is redelivered once the ack timeout expires
+	time.Sleep(400 * time.Millisecond)
+	msg, err = subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "first" {
+		t.Errorf("Expected unacknowledged message first to be redelivered got %s", msg.Payload.Message)
+	}
+	if err = subscriber.Ack(msg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Ack(msg); err == nil {
+		t.Errorf("Expected error acknowledging the same message twice got none")
+	}
+}
+
+func TestRedeliveryOnDisconnect(t *testing.T) {
+	b := broker.New("127.0.0.1:3203")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	opts := SubscribeOptions{Group: "workers", Ack: true}
+	crashing, err := NewSubscriber("127.0.0.1:3203")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = crashing.SubscribeWith("default", opts); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	worker, err := NewSubscriber("127.0.0.1:3203")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer worker.Close()
+	if err = worker.SubscribeWith("default", opts); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3203")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"default","message":"Hello World!"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if _, err = crashing.Receive("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	crashing.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	msg, err := worker.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "Hello World!" {
+		t.Errorf("Expected to receive Hello World! got %s", msg.Payload.Message)
+	}
+}
+
+func TestSubscriberStream(t *testing.T) {
+	b := broker.New("127.0.0.1:3204")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3204")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	ch, err := subscriber.Stream("default", SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3204")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-ch:
+			if msg.Payload.Message != fmt.Sprint(i) {
+				t.Errorf("Expected to receive %d got %s", i, msg.Payload.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d to be pushed", i)
+		}
+	}
+}
+
+func TestGroupStreamFunc(t *testing.T) {
+	b := broker.New("127.0.0.1:3205")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	received := make(chan string, 4)
+	opts := SubscribeOptions{Group: "workers", Ack: true}
+	for i := 0; i < 2; i++ {
+		worker, err := NewSubscriber("127.0.0.1:3205")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		defer worker.Close()
+		name := fmt.Sprintf("worker%d", i)
+		err = worker.StreamFunc("default", opts, func(msg *protocol.DefaultMessage) {
+			if err := worker.Ack(msg); err != nil {
+				t.Errorf("Error: %s", err)
+			}
+			received <- name
+		})
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	publisher, err := NewPublisher("127.0.0.1:3205")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		select {
+		case name := <-received:
+			counts[name]++
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 4 messages to be pushed got %d", i)
+		}
+	}
+	if counts["worker0"] != 2 || counts["worker1"] != 2 {
+		t.Errorf("Expected workers to take turns got %v", counts)
+	}
+}
+
+func TestStreamPrefetch(t *testing.T) {
+	b := broker.New("127.0.0.1:3206")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	acking, err := NewSubscriber("127.0.0.1:3206")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer acking.Close()
+	ackCh, err := acking.Stream("default", SubscribeOptions{Ack: true, Prefetch: 2})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	crediting, err := NewSubscriber("127.0.0.1:3206")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer crediting.Close()
+	creditCh, err := crediting.Stream("default", SubscribeOptions{Prefetch: 2})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3206")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = publisher.Publish(fmt.Sprintf(`{"topic":"default","message":"%d"}`, i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// Only two unacknowledged messages are pushed
+	var first *protocol.DefaultMessage
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-ackCh:
+			if first == nil {
+				first = msg
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d to be pushed", i)
+		}
+	}
+	select {
+	case msg := <-ackCh:
+		t.Fatalf("Expected no more than 2 messages in flight got %s", msg.Payload.Message)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err = acking.Ack(first); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	select {
+	case msg := <-ackCh:
+		if msg.Payload.Message != "2" {
+			t.Errorf("Expected to receive 2 after acknowledging got %s", msg.Payload.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a message to be pushed after acknowledging")
+	}
+
+	// Without acknowledgements credits are granted as the messages are taken
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-creditCh:
+			if msg.Payload.Message != fmt.Sprint(i) {
+				t.Errorf("Expected to receive %d got %s", i, msg.Payload.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d to be pushed", i)
+		}
+	}
+}
+
+func TestReceiveWait(t *testing.T) {
+	b := broker.New("127.0.0.1:3207")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3207")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3207")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if _, err = subscriber.ReceiveWait("default", 100*time.Millisecond); err != ErrNoMessage {
+		t.Fatalf("Expected ErrNoMessage got %v", err)
+	}
+	if _, err = subscriber.Receive("default"); err == nil {
+		t.Fatalf("Expected error receiving from an empty queue got none")
+	}
+
+	// Connection is still usable and the parked request is completed once a message arrives
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		publisher.Publish(`{"topic":"default","message":"Hello World!"}`)
+	}()
+	msg, err := subscriber.ReceiveWait("default", 2*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != "Hello World!" {
+		t.Errorf("Expected to receive Hello World! got %s", msg.Payload.Message)
+	}
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	b := broker.New("127.0.0.1:3208")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3208", WithBinaryProtocol())
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	// Text clients keep working next to binary ones
+	textSubscriber, err := NewSubscriber("127.0.0.1:3208")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer textSubscriber.Close()
+	if err = textSubscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3208", WithBinaryProtocol())
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	message := []byte("line one\nline \"two\"\x00\xff")
+	if err = publisher.PublishMessage("default", message); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	msg, err := subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != string(message) {
+		t.Errorf("Expected to receive %q got %q", message, msg.Payload.Message)
+	}
+	msg, err = textSubscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if !strings.HasPrefix(msg.Payload.Message, "line one\nline \"two\"") {
+		t.Errorf("Expected text subscriber to receive %q got %q", message, msg.Payload.Message)
+	}
+}
+
+func TestStreamPattern(t *testing.T) {
+	b := broker.New("127.0.0.1:3209")
+	b.AddTopic("orders.eu")
+	b.AddTopic("orders.us")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3209")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	ch, err := subscriber.Stream("orders.*", SubscribeOptions{Prefetch: 1})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3209")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		for _, topic := range []string{"orders.eu", "orders.us"} {
+			if err = publisher.Publish(fmt.Sprintf(`{"topic":"%s","message":"%d"}`, topic, i)); err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+		}
+	}
+
+	// Credits are given back to the topic each message came from
+	received := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-ch:
+			received[msg.Payload.Topic]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 4 messages got %v", received)
+		}
+	}
+	if received["orders.eu"] != 2 || received["orders.us"] != 2 {
+		t.Errorf("Expected 2 messages from each topic got %v", received)
+	}
+}
+
+func TestPublishHeaders(t *testing.T) {
+	b := broker.New("127.0.0.1:3210")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3210")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3210", WithBinaryProtocol())
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	headers := map[string]string{"correlation-id": "42", "content-type": "application/json"}
+	if _, err = publisher.PublishWith("default", []byte(`{"total":10}`), PublishOptions{Headers: headers}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.Publish(`{"topic":"default","message":"plain"}`); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	msg, err := subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg.Payload.Message != `{"total":10}` || msg.Payload.Headers["correlation-id"] != "42" || msg.Payload.Headers["content-type"] != "application/json" {
+		t.Errorf("Expected message with headers %v got %s with %v", headers, msg.Payload.Message, msg.Payload.Headers)
+	}
+	msg, err = subscriber.Receive("default")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(msg.Payload.Headers) != 0 {
+		t.Errorf("Expected no headers got %v", msg.Payload.Headers)
+	}
+}
+
+func TestMessageIds(t *testing.T) {
+	b := broker.New("127.0.0.1:3211")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3211")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3211")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := publisher.PublishWith("default", []byte(fmt.Sprintf("%d", i)), PublishOptions{})
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if id == "" || (len(ids) > 0 && id <= ids[len(ids)-1]) {
+			t.Errorf("Expected unique ids sorted in publish order got %s after %v", id, ids)
+		}
+		ids = append(ids, id)
+	}
+
+	for i := 0; i < 3; i++ {
+		msg, err := subscriber.Receive("default")
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if msg.Payload.Id != ids[i] || msg.Payload.Sequence != int64(i+1) || msg.Payload.Timestamp == 0 {
+			t.Errorf("Expected id %s and sequence %d with a timestamp got %s, %d and %d",
+				ids[i], i+1, msg.Payload.Id, msg.Payload.Sequence, msg.Payload.Timestamp)
+		}
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	b := broker.New("127.0.0.1:3212")
+	b.AddTopic("ping")
+	b.AddTopic("slow")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	responder, err := NewSubscriber("127.0.0.1:3212")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer responder.Close()
+	err = responder.StreamFunc("ping", SubscribeOptions{}, func(msg *protocol.DefaultMessage) {
+		if err := responder.Reply(msg, []byte("pong "+msg.Payload.Message)); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	slow, err := NewSubscriber("127.0.0.1:3212")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer slow.Close()
+	if err = slow.Subscribe("slow"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	requester, err := NewPublisher("127.0.0.1:3212")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		reply, err := requester.Request("ping", []byte(fmt.Sprintf("%d", i)), time.Second)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if reply.Payload.Message != fmt.Sprintf("pong %d", i) {
+			t.Errorf("Expected pong %d got %s", i, reply.Payload.Message)
+		}
+	}
+
+	if _, err = requester.Request("slow", []byte("ping"), 100*time.Millisecond); err != ErrNoReply {
+		t.Errorf("Expected ErrNoReply got %v", err)
+	}
+	msg, err := slow.Receive("slow")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if !protocol.IsInbox(msg.Payload.ReplyTo) {
+		t.Errorf("Expected the request to carry its reply inbox got %q", msg.Payload.ReplyTo)
+	}
+	// Inbox is dropped once the request times out
+	if err = slow.Reply(msg, []byte("pong")); err == nil {
+		t.Errorf("Expected error replying to the inbox of a timed out request got none")
+	}
+
+	// and together with the connection of the requester
+	go requester.Request("slow", []byte("ping"), time.Minute)
+	if msg, err = slow.ReceiveWait("slow", time.Second); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	requester.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err = slow.Reply(msg, []byte("pong")); err == nil {
+		t.Errorf("Expected error replying to the inbox of a disconnected requester got none")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	b := broker.New("127.0.0.1:3213")
+	b.AddTopic("default")
+	b.AddTopic("orders.eu")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3213")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	publisher, err := NewPublisher("127.0.0.1:3213")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if created, err := subscriber.SubscribeWithStatus("default", SubscribeOptions{}); err != nil || !created {
+		t.Fatalf("Expected a new subscription got %t (%v)", created, err)
+	}
+	if created, err := subscriber.SubscribeWithStatus("default", SubscribeOptions{}); err != nil || created {
+		t.Fatalf("Expected to re-attach to the existing subscription got %t (%v)", created, err)
+	}
+	for _, message := range []string{"first", "second"} {
+		if err = publisher.PublishMessage("default", []byte(message)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// Drained subscription delivers what was queued but gets nothing new
+	if err = subscriber.UnsubscribeWith("default", UnsubscribeOptions{Drain: true}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.PublishMessage("default", []byte("third")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for _, message := range []string{"first", "second"} {
+		msg, err := subscriber.Receive("default")
+		if err != nil || msg.Payload.Message != message {
+			t.Fatalf("Expected %s from the draining subscription got %+v (%v)", message, msg, err)
+		}
+	}
+	if _, err = subscriber.Receive("default"); err == nil {
+		t.Errorf("Expected error receiving from the drained subscription got none")
+	}
+
+	// Discarded queue is gone together with the subscription
+	if created, err := subscriber.SubscribeWithStatus("default", SubscribeOptions{}); err != nil || !created {
+		t.Fatalf("Expected a new subscription got %t (%v)", created, err)
+	}
+	if err = publisher.PublishMessage("default", []byte("fourth")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Unsubscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err = subscriber.Receive("default"); err == nil {
+		t.Errorf("Expected error receiving after unsubscribing got none")
+	}
+
+	if err = subscriber.Subscribe("orders.*"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = subscriber.Unsubscribe("orders.*"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = publisher.PublishMessage("orders.eu", []byte("order")); err == nil {
+		t.Errorf("Expected error publishing to a topic nobody is subscribed to got none")
+	}
+	if err = subscriber.Unsubscribe("orders.*"); err == nil {
+		t.Errorf("Expected error unsubscribing from a pattern twice got none")
+	}
+}
+
+func TestClient(t *testing.T) {
+	b := broker.New("127.0.0.1:3214")
+	b.AddTopic("orders")
+	b.AddTopic("audit")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	// Service consumes orders and publishes to the audit topic over the same connection
+	service, err := NewClient("127.0.0.1:3214")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer service.Close()
+	err = service.StreamFunc("orders", SubscribeOptions{}, func(msg *protocol.DefaultMessage) {
+		if err := service.PublishMessage("audit", []byte(msg.Payload.Message)); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		if err := service.Reply(msg, []byte("accepted "+msg.Payload.Message)); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	caller, err := NewClient("127.0.0.1:3214", WithBinaryProtocol())
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer caller.Close()
+	if err = caller.Subscribe("audit"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		order := fmt.Sprintf("order-%d", i)
+		reply, err := caller.Request("orders", []byte(order), time.Second)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if reply.Payload.Message != "accepted "+order {
+			t.Errorf("Expected accepted %s got %s", order, reply.Payload.Message)
+		}
+		msg, err := caller.Receive("audit")
+		if err != nil || msg.Payload.Message != order {
+			t.Errorf("Expected %s in the audit topic got %+v (%v)", order, msg, err)
+		}
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	b := broker.New("127.0.0.1:3215")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	c, err := NewClient("127.0.0.1:3215")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err = c.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// Replies reach the goroutines that sent the requests, errors included
+	var wg sync.WaitGroup
+	ids := make([]string, 50)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%5 == 0 {
+				if _, err := c.PublishWith("missing", []byte("lost"), PublishOptions{}); err == nil {
+					t.Errorf("Expected error publishing to a missing topic got none")
+				}
+				return
+			}
+			id, err := c.PublishWith("default", []byte(fmt.Sprintf("%d", i)), PublishOptions{})
+			if err != nil {
+				t.Errorf("Error: %s", err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for i, id := range ids {
+		if i%5 != 0 && (id == "" || seen[id]) {
+			t.Errorf("Expected a distinct id for every publish got %q", id)
+		}
+		seen[id] = true
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := c.Receive("default"); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	// Long poll doesn't hold up the requests sent after it, which complete first
+	received := make(chan *protocol.DefaultMessage, 1)
+	go func() {
+		msg, err := c.ReceiveWait("default", 2*time.Second)
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		received <- msg
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if err = c.PublishMessage("default", []byte("late")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if msg := <-received; msg == nil || msg.Payload.Message != "late" || time.Since(start) > time.Second {
+		t.Errorf("Expected the waiting receive to get late right away got %+v after %s", msg, time.Since(start))
+	}
+
+	// Requests in flight fail once the connection is closed
+	failed := make(chan error, 1)
+	go func() {
+		_, err := c.ReceiveWait("default", 5*time.Second)
+		failed <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	if err := <-failed; err != ErrClosed {
+		t.Errorf("Expected ErrClosed got %v", err)
+	}
+	if err = c.PublishMessage("default", []byte("closed")); err == nil {
+		t.Errorf("Expected error publishing over a closed connection got none")
+	}
+}
+
+func TestPublishAsync(t *testing.T) {
+	b := broker.New("127.0.0.1:3216")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3216")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	if err = subscriber.Subscribe("default"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	publisher, err := NewPublisher("127.0.0.1:3216", WithBatchSize(10), WithLinger(time.Hour))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer publisher.Close()
+
+	futures := make([]*PublishFuture, 25)
+	for i := range futures {
+		futures[i] = publisher.PublishAsync("default", []byte(fmt.Sprintf("%d", i)), PublishOptions{})
+	}
+	failed := make(chan error, 1)
+	publisher.PublishAsyncFunc("missing", []byte("lost"), PublishOptions{}, func(id string, err error) {
+		failed <- err
+	})
+	// Last batch isn't full and waits for the linger time unless flushed
+	if err = publisher.Flush(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	ids := make(map[string]bool)
+	for i, future := range futures {
+		select {
+		case <-future.Done():
+		default:
+			t.Fatalf("Expected every publish to be confirmed after Flush")
+		}
+		id, err := future.Wait()
+		if err != nil || id == "" || ids[id] {
+			t.Errorf("Expected a distinct id for message %d got %q (%v)", i, id, err)
+		}
+		ids[id] = true
+	}
+	if err := <-failed; err == nil {
+		t.Errorf("Expected the callback to get an error publishing to a missing topic got none")
+	}
+	// Synchronous publish writes the batch first, so the messages keep their order
+	publisher.PublishAsync("default", []byte("async"), PublishOptions{})
+	if err = publisher.PublishMessage("default", []byte("sync")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	for i := 0; i < 25; i++ {
+		msg, err := subscriber.Receive("default")
+		if err != nil || msg.Payload.Message != fmt.Sprintf("%d", i) {
+			t.Fatalf("Expected %d got %+v (%v)", i, msg, err)
+		}
+	}
+	for _, message := range []string{"async", "sync"} {
+		msg, err := subscriber.Receive("default")
+		if err != nil || msg.Payload.Message != message {
+			t.Fatalf("Expected %s got %+v (%v)", message, msg, err)
+		}
+	}
+
+	// Batch is written once the linger time passes, without Flush
+	lingering, err := NewPublisher("127.0.0.1:3216", WithLinger(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer lingering.Close()
+	future := lingering.PublishAsync("default", []byte("lingering"), PublishOptions{})
+	select {
+	case <-future.Done():
+		if _, err := future.Wait(); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the batch to be written once the linger time passed")
+	}
+
+	// Messages still waiting in the batch fail when the connection is closed
+	future = publisher.PublishAsync("default", []byte("unsent"), PublishOptions{})
+	publisher.Close()
+	if _, err = future.Wait(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed got %v", err)
+	}
+	if _, err = publisher.PublishAsync("default", []byte("closed"), PublishOptions{}).Wait(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed publishing over a closed connection got %v", err)
+	}
+}
+
+func TestUnexpectedCommands(t *testing.T) {
+	b := broker.New("127.0.0.1:3218")
+	b.AddTopic("default")
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer b.Stop()
+
+	subscriber, err := NewSubscriber("127.0.0.1:3218")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer subscriber.Close()
+	// Requests the broker doesn't serve are answered instead of leaving the caller waiting
+	if err = subscriber.request(protocol.CMD_OK, nil); err == nil || err.Error() != "unsupported command" {
+		t.Errorf("Expected unsupported command got %v", err)
+	}
+	if err = subscriber.request(protocol.CMD_REDRIVE, &protocol.DefaultPayload{Topic: "default"}); err == nil || err.Error() != "must be registered as a publisher" {
+		t.Errorf("Expected must be registered as a publisher got %v", err)
+	}
+}
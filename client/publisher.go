@@ -1,106 +1,250 @@
 package client
 
 import (
-	"bufio"
+	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
-	"net"
+	"time"
 
 	"github.com/marcell7/MQ/protocol"
 )
 
+// Returned by Request when no reply arrived before the request timed out
+var ErrNoReply = errors.New("no reply arrived before the request timed out")
+
 type Publisher interface {
-	Publish() error  // Publishes user provided item/message to the specified topic
-	start() error    // Starts listening for incoming messages
-	connect() error  // Connects the client to the broker (tcp server)
-	register() error // Registers the client as a publisher on the broker
+	Publish() error                                                          // Publishes user provided item/message to the specified topic
+	PublishMessage(string, []byte) error                                     // Publishes raw message bytes to the topic
+	PublishWith(string, []byte, PublishOptions) (string, error)              // Publishes the message to the topic with the provided options. Returns the id the broker assigned to it
+	PublishAsync(string, []byte, PublishOptions) *PublishFuture              // Publishes the message without waiting for the broker to confirm it
+	PublishAsyncFunc(string, []byte, PublishOptions, func(string, error))    // Publishes the message and calls the callback once the broker confirms it
+	Flush() error                                                            // Waits until the broker confirmed every message published asynchronously
+	ClearRetained(string) error                                              // Clears the retained message of the topic
+	Redrive(string, int) error                                               // Moves messages from the dead-letter topic back to their original topics
+	Request(string, []byte, time.Duration) (*protocol.DefaultMessage, error) // Publishes the message to the topic and waits for a subscriber to reply to it
+	start() error                                                            // Starts listening for incoming messages
+	connect() error                                                          // Connects the client to the broker (tcp server)
+	register() error                                                         // Registers the client as a publisher on the broker
 }
 
 // Implements Publisher interface
 type DefaultPublisher struct {
-	addr     string                        // Address of the broker
-	conn     net.Conn                      // Connection of that specific subscriber - allows for writing and receiving messages from / to the broker
-	protocol protocol.Protocol             // Protocol instance for decoding messages
-	okCh     chan struct{}                 // Channel for signaling succesfully processed messages
-	errCh    chan *protocol.DefaultMessage // Channel used for receiving messages from the broker
+	*session
 }
 
 // Constructor for the DefaultPublisher struct
-func NewPublisher(addr string) (*DefaultPublisher, error) {
-	dp := &DefaultPublisher{
-		addr:     addr,
-		protocol: new(protocol.DefaultProtocol),
-		okCh:     make(chan struct{}),
-		errCh:    make(chan *protocol.DefaultMessage),
-	}
-	if err := dp.connect(); err != nil {
-		return nil, err
-	}
-
-	go dp.start()
-
-	if err := dp.register(); err != nil {
+func NewPublisher(addr string, opts ...Option) (*DefaultPublisher, error) {
+	dp := &DefaultPublisher{session: newSession(addr, opts)}
+	if err := dp.open(dp.register); err != nil {
 		return nil, err
 	}
 	return dp, nil
 }
 
+// Payload is the JSON encoded payload of the PUB command - {"topic":"<topic>","message":"<message>"}
 func (dp *DefaultPublisher) Publish(payload string) error {
-	if _, err := dp.conn.Write([]byte(fmt.Sprintf("PUB %s\n", payload))); err != nil {
+	p := new(protocol.DefaultPayload)
+	if err := json.Unmarshal([]byte(payload), p); err != nil {
 		return err
 	}
-	select {
-	case <-dp.okCh:
-		return nil
-	case errMsg := <-dp.errCh:
-		return errors.New(errMsg.Payload.Error)
-	}
-}
-
-func (dp *DefaultPublisher) start() error {
-	reader := bufio.NewReader(dp.conn)
-	for {
-		data, _, err := reader.ReadLine()
-		if err != nil {
-			if err == io.EOF {
-				return err
-			} else {
-				fmt.Printf("error: %s\n", err)
-				return err
-			}
-		}
-		msg := &protocol.DefaultMessage{}
-		if err := dp.protocol.Decode(msg, data); err != nil {
-			fmt.Println("Error decoding")
-			return err
-		}
-		switch msg.Command {
-		case protocol.CMD_OK:
-			dp.okCh <- struct{}{}
-		case protocol.CMD_ERROR:
-			dp.errCh <- msg
-		}
-	}
-}
-
-func (dp *DefaultPublisher) connect() error {
-	conn, err := net.Dial("tcp", dp.addr)
+	return dp.request(protocol.CMD_PUB, p)
+}
+
+// Settings of a published message
+type PublishOptions struct {
+	Headers   map[string]string // Metadata delivered to subscribers together with the message (e.g. correlation id, content type)
+	TTL       time.Duration     // Time after which the message is discarded if it was not delivered yet. Topic's TTL is used if zero
+	Delay     time.Duration     // Time after which the message becomes visible to subscribers. Delivered right away if zero
+	DeliverAt time.Time         // Time at which the message becomes visible to subscribers. Takes precedence over Delay
+	Priority  int               // Messages with higher priority are delivered first. Ignored by topics without priorities
+	Retain    bool              // Topic keeps the message and delivers it to every new subscription until another retained message replaces it
+	DedupKey  string            // Key identifying the message (e.g. "<producer id>:<sequence>"). Publishing it again with the same key within the topic's dedup window is a no-op
+}
+
+// Message is sent as is. Prefer it over Publish for binary data when speaking the binary protocol
+func (dp *DefaultPublisher) PublishMessage(topic string, message []byte) error {
+	_, err := dp.PublishWith(topic, message, PublishOptions{})
+	return err
+}
+
+// Retrying with the same DedupKey is safe - the broker drops the duplicate and returns the id of the message published first
+func (dp *DefaultPublisher) PublishWith(topic string, message []byte, opts PublishOptions) (string, error) {
+	ok, err := dp.call(protocol.CMD_PUB, publishPayload(topic, message, opts))
 	if err != nil {
+		return "", err
+	}
+	return ok.Payload.Id, nil
+}
+
+// Result of a message published with PublishAsync
+type PublishFuture struct {
+	done     chan struct{}       // Closed once the broker confirmed the message or the publish failed
+	id       string              // Id the broker assigned to the message
+	err      error               // Why the publish failed
+	callback func(string, error) // Called once the future completes. Can be nil
+}
+
+func newPublishFuture(callback func(string, error)) *PublishFuture {
+	return &PublishFuture{done: make(chan struct{}), callback: callback}
+}
+
+// Returns a channel that is closed once the publish completes
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Waits for the broker to confirm the message and returns the id it assigned to it
+func (f *PublishFuture) Wait() (string, error) {
+	<-f.done
+	return f.id, f.err
+}
+
+func (f *PublishFuture) complete(reply *protocol.DefaultMessage) {
+	switch {
+	case reply == nil:
+		f.err = ErrClosed
+	case reply.Command != protocol.CMD_OK:
+		f.err = replyError(reply)
+	default:
+		f.id = reply.Payload.Id
+	}
+	f.finish()
+}
+
+// Completes the future. Callback is called from a separate goroutine so that it can use the publisher
+func (f *PublishFuture) finish() {
+	close(f.done)
+	if f.callback != nil {
+		go f.callback(f.id, f.err)
+	}
+}
+
+// Returns without waiting for the broker. Message is written together with other messages published asynchronously
+// once the batch is full or the linger time passes (see WithBatchSize, WithBatchBytes and WithLinger)
+func (dp *DefaultPublisher) PublishAsync(topic string, message []byte, opts PublishOptions) *PublishFuture {
+	return dp.publishAsync(topic, message, opts, nil)
+}
+
+// Callback is called from a separate goroutine with the id the broker assigned to the message, or with the error
+func (dp *DefaultPublisher) PublishAsyncFunc(topic string, message []byte, opts PublishOptions, callback func(string, error)) {
+	dp.publishAsync(topic, message, opts, callback)
+}
+
+func (dp *DefaultPublisher) publishAsync(topic string, message []byte, opts PublishOptions, callback func(string, error)) *PublishFuture {
+	future := newPublishFuture(callback)
+	if err := dp.roundTripAsync(protocol.CMD_PUB, publishPayload(topic, message, opts), future.complete); err != nil {
+		future.err = err
+		future.finish()
+	}
+	return future
+}
+
+// Writes the messages waiting in the batch and waits until the broker confirmed every message published asynchronously
+func (dp *DefaultPublisher) Flush() error {
+	if err := dp.flushBatch(); err != nil {
 		return err
 	}
-	dp.conn = conn
+	dp.waitAsync()
 	return nil
 }
 
-func (dp *DefaultPublisher) register() error {
-	if _, err := dp.conn.Write([]byte("PUBREG\n")); err != nil {
-		return err
+// Builds the payload of PUB
+func publishPayload(topic string, message []byte, opts PublishOptions) *protocol.DefaultPayload {
+	payload := &protocol.DefaultPayload{
+		Topic:    topic,
+		Message:  string(message),
+		Headers:  opts.Headers,
+		TTL:      opts.TTL.Milliseconds(),
+		DedupKey: opts.DedupKey,
+		Delay:    opts.Delay.Milliseconds(),
+		Priority: opts.Priority,
+		Retain:   opts.Retain,
+	}
+	if !opts.DeliverAt.IsZero() {
+		payload.DeliverAt = opts.DeliverAt.UnixMilli()
+	}
+	return payload
+}
+
+// Subscriptions created afterwards no longer get the retained message. Messages already queued are still delivered
+func (dp *DefaultPublisher) ClearRetained(topic string) error {
+	return dp.request(protocol.CMD_PUB, &protocol.DefaultPayload{Topic: topic, Retain: true})
+}
+
+// Reply is sent to an inbox the broker creates for this request only. Subscribers reply with DefaultSubscriber.Reply.
+// Returns ErrNoReply if the reply doesn't arrive within the timeout
+func (dp *DefaultPublisher) Request(topic string, message []byte, timeout time.Duration) (*protocol.DefaultMessage, error) {
+	// Broker drops the inbox once the request times out
+	wait := timeout.Milliseconds()
+	if wait < 1 {
+		wait = 1
+	}
+	ok, err := dp.call(protocol.CMD_INBOX, &protocol.DefaultPayload{Wait: wait})
+	if err != nil {
+		return nil, err
 	}
+	inbox := ok.Payload.Topic
+	replyCh := make(chan *protocol.DefaultMessage, 1)
+	dp.mu.Lock()
+	dp.inboxes[inbox] = replyCh
+	dp.mu.Unlock()
+	defer func() {
+		dp.mu.Lock()
+		delete(dp.inboxes, inbox)
+		dp.mu.Unlock()
+	}()
+	if err := dp.request(protocol.CMD_PUB, &protocol.DefaultPayload{Topic: topic, Message: string(message), ReplyTo: inbox}); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
-	case <-dp.okCh:
-		return nil
-	case errMsg := <-dp.errCh:
-		return errors.New(errMsg.Payload.Error)
+	case reply := <-replyCh:
+		return reply, nil
+	case <-timer.C:
+		return nil, ErrNoReply
+	}
+}
+
+// Moves up to limit messages (all if limit <= 0) from the dead-letter topic back to the topics they were originally published to
+func (dp *DefaultPublisher) Redrive(topic string, limit int) error {
+	return dp.request(protocol.CMD_REDRIVE, &protocol.DefaultPayload{Topic: topic, Limit: limit})
+}
+
+func (dp *DefaultPublisher) CreateTopic(topic string, config protocol.TopicConfig) error {
+	return dp.request(protocol.CMD_TOPIC_CREATE, &protocol.DefaultPayload{Topic: topic, Config: &config})
+}
+
+func (dp *DefaultPublisher) DeleteTopic(topic string) error {
+	return dp.request(protocol.CMD_TOPIC_DELETE, &protocol.DefaultPayload{Topic: topic})
+}
+
+func (dp *DefaultPublisher) ListTopics() ([]protocol.TopicInfo, error) {
+	return dp.topics(protocol.CMD_TOPIC_LIST, &protocol.DefaultPayload{})
+}
+
+func (dp *DefaultPublisher) TopicInfo(topic string) (*protocol.TopicInfo, error) {
+	topics, err := dp.topics(protocol.CMD_TOPIC_INFO, &protocol.DefaultPayload{Topic: topic})
+	if err != nil {
+		return nil, err
+	}
+	if len(topics) != 1 {
+		return nil, errors.New("unexpected reply from the broker")
 	}
+	return &topics[0], nil
+}
+
+// Sends the command and waits for the state of the topics
+func (dp *DefaultPublisher) topics(command protocol.Command, payload *protocol.DefaultPayload) ([]protocol.TopicInfo, error) {
+	reply, err := dp.roundTrip(command, payload)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Command != protocol.CMD_TOPICS {
+		return nil, replyError(reply)
+	}
+	return reply.Payload.Topics, nil
+}
+
+func (dp *DefaultPublisher) register() error {
+	return dp.request(protocol.CMD_PUBREG, nil)
 }
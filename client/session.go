@@ -0,0 +1,366 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcell7/MQ/protocol"
+)
+
+// Returned by requests that were in flight (or sent) after the connection to the broker was closed
+var ErrClosed = errors.New("connection to the broker is closed")
+
+// Connection to the broker. Shared by the publishing and the subscribing side of a client.
+// Requests can be sent from many goroutines at once - every request carries an id the broker echoes in its reply
+type session struct {
+	addr        string                                    // Address of the broker
+	conn        net.Conn                                  // Connection of the client - allows for writing and receiving messages from / to the broker
+	protocol    protocol.Protocol                         // Protocol instance for encoding and decoding messages
+	name        string                                    // Durable name of the subscriber. Empty if its subscriptions are deleted on disconnect
+	writeMu     sync.Mutex                                // mutex for writing to the connection and for the batch
+	batch       []byte                                    // Encoded messages waiting to be written to the connection at once
+	batched     int                                       // Number of messages in the batch
+	lingerTimer *time.Timer                               // Writes the batch once the linger time passes. Nil if the batch is empty
+	batchSize   int                                       // Maximum number of messages in the batch
+	batchBytes  int                                       // Maximum size of the batch in bytes
+	linger      time.Duration                             // Time the batch waits for more messages before it's written
+	mu          sync.Mutex                                // mutex for the streams, inboxes and pending maps
+	idle        *sync.Cond                                // signals that no asynchronous request is waiting for a reply
+	streams     map[string]*stream                        // Streamed topics and patterns. Messages pushed by the broker are routed to them - {"<topic>":"<stream>"}
+	inboxes     map[string]chan *protocol.DefaultMessage  // Inboxes of the requests waiting for a reply - {"<inbox>":"<channel>"}
+	pending     map[string]func(*protocol.DefaultMessage) // Requests waiting for the broker's reply. Called with the reply, or nil if the connection is closed - {"<request id>":"<func>"}
+	async       int                                       // Number of asynchronous requests waiting for a reply
+	lastRequest uint64                                    // Id of the last request sent
+	closed      bool                                      // Set once the connection is closed. No more replies arrive
+}
+
+// Constructor for the session struct
+func newSession(addr string, opts []Option) *session {
+	o := newOptions(opts)
+	s := &session{
+		addr:       addr,
+		protocol:   o.protocol,
+		name:       o.name,
+		batchSize:  o.batchSize,
+		batchBytes: o.batchBytes,
+		linger:     o.linger,
+		streams:    make(map[string]*stream),
+		inboxes:    make(map[string]chan *protocol.DefaultMessage),
+		pending:    make(map[string]func(*protocol.DefaultMessage)),
+	}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// Connects to the broker, starts listening for incoming messages and registers with the command
+func (s *session) open(register func() error) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	go s.start()
+
+	return register()
+}
+
+// Sends the command and waits for the broker to process it
+func (s *session) request(command protocol.Command, payload *protocol.DefaultPayload) error {
+	_, err := s.call(command, payload)
+	return err
+}
+
+// Sends the command and returns the broker's OK
+func (s *session) call(command protocol.Command, payload *protocol.DefaultPayload) (*protocol.DefaultMessage, error) {
+	reply, err := s.roundTrip(command, payload)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Command != protocol.CMD_OK {
+		return nil, replyError(reply)
+	}
+	return reply, nil
+}
+
+// Sends the command and waits for the broker's reply to it, whatever the reply is.
+// Replies to other requests sent in the meantime don't get mixed up with it
+func (s *session) roundTrip(command protocol.Command, payload *protocol.DefaultPayload) (*protocol.DefaultMessage, error) {
+	if payload == nil {
+		payload = new(protocol.DefaultPayload)
+	}
+	replyCh := make(chan *protocol.DefaultMessage, 1)
+	if err := s.track(payload, false, func(reply *protocol.DefaultMessage) { replyCh <- reply }); err != nil {
+		return nil, err
+	}
+	if err := s.send(command, payload); err != nil {
+		s.untrack(payload, false)
+		return nil, err
+	}
+	reply := <-replyCh
+	if reply == nil {
+		return nil, ErrClosed
+	}
+	return reply, nil
+}
+
+// Adds the command to the batch without waiting for the reply. Done is called with the reply,
+// or with nil if the connection is closed before the reply arrives
+func (s *session) roundTripAsync(command protocol.Command, payload *protocol.DefaultPayload, done func(*protocol.DefaultMessage)) error {
+	if err := s.track(payload, true, done); err != nil {
+		return err
+	}
+	if err := s.queue(command, payload); err != nil {
+		s.untrack(payload, true)
+		return err
+	}
+	return nil
+}
+
+// Gives the request an id and waits for the reply with it
+func (s *session) track(payload *protocol.DefaultPayload, async bool, done func(*protocol.DefaultMessage)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.lastRequest++
+	payload.Request = strconv.FormatUint(s.lastRequest, 10)
+	if async {
+		s.async++
+		done = s.completeAsync(done)
+	}
+	s.pending[payload.Request] = done
+	return nil
+}
+
+// Stops waiting for the reply to the request that couldn't be sent
+func (s *session) untrack(payload *protocol.DefaultPayload, async bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[payload.Request]; !ok {
+		return
+	}
+	delete(s.pending, payload.Request)
+	if async {
+		s.finishAsync()
+	}
+}
+
+// Wraps done so that the asynchronous request is no longer counted once it completes
+func (s *session) completeAsync(done func(*protocol.DefaultMessage)) func(*protocol.DefaultMessage) {
+	return func(reply *protocol.DefaultMessage) {
+		done(reply)
+		s.mu.Lock()
+		s.finishAsync()
+		s.mu.Unlock()
+	}
+}
+
+func (s *session) finishAsync() {
+	s.async--
+	if s.async == 0 {
+		s.idle.Broadcast()
+	}
+}
+
+// Waits until every asynchronous request got its reply (or the connection was closed)
+func (s *session) waitAsync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.async > 0 {
+		s.idle.Wait()
+	}
+}
+
+// Writes the message to the connection. Messages waiting in the batch are written first, so the broker
+// gets the messages in the order they were sent
+func (s *session) send(command protocol.Command, payload *protocol.DefaultPayload) error {
+	data, err := s.protocol.Encode(&protocol.DefaultMessage{Command: command, Payload: payload})
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.batch = append(s.batch, data...)
+	s.batched++
+	return s.writeBatch()
+}
+
+// Adds the message to the batch. Batch is written once it's full or the linger time passes
+func (s *session) queue(command protocol.Command, payload *protocol.DefaultPayload) error {
+	data, err := s.protocol.Encode(&protocol.DefaultMessage{Command: command, Payload: payload})
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.batch = append(s.batch, data...)
+	s.batched++
+	if s.batched >= s.batchSize || len(s.batch) >= s.batchBytes || s.linger <= 0 {
+		return s.writeBatch()
+	}
+	if s.lingerTimer == nil {
+		s.lingerTimer = time.AfterFunc(s.linger, func() {
+			if err := s.flushBatch(); err != nil {
+				fmt.Printf("error writing the batch: %s\n", err)
+			}
+		})
+	}
+	return nil
+}
+
+// Writes the messages waiting in the batch without waiting for the linger time
+func (s *session) flushBatch() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.writeBatch()
+}
+
+// Writes the batch to the connection with a single write. Has to be called with writeMu held.
+// Connection is closed if the write fails, which fails the requests waiting for a reply
+func (s *session) writeBatch() error {
+	if s.lingerTimer != nil {
+		s.lingerTimer.Stop()
+		s.lingerTimer = nil
+	}
+	if s.batched == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.batch)
+	s.batch = s.batch[:0]
+	s.batched = 0
+	if err != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+// Returns the error the broker replied with
+func replyError(reply *protocol.DefaultMessage) error {
+	if reply.Command == protocol.CMD_ERROR {
+		return errors.New(reply.Payload.Error)
+	}
+	return fmt.Errorf("unexpected reply %s from the broker", reply.Command)
+}
+
+func (s *session) Close() error {
+	if err := s.conn.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *session) start() error {
+	defer s.closeStreams()
+	defer s.failPending()
+	reader := bufio.NewReader(s.conn)
+	for {
+		data, err := s.protocol.ReadFrame(reader)
+		if err != nil {
+			if err == io.EOF {
+				return err
+			} else {
+				fmt.Printf("error: %s\n", err)
+				return err
+			}
+		}
+		msg := &protocol.DefaultMessage{}
+		if err := s.protocol.Decode(msg, data); err != nil {
+			fmt.Println("Error decoding")
+			return err
+		}
+		if msg.Payload.Request != "" {
+			s.complete(msg)
+			continue
+		}
+		// Messages without a request id are pushed by the broker
+		if msg.Command == protocol.CMD_RESP && !s.reply(msg) {
+			if st := s.stream(msg.Payload.Topic); st != nil {
+				st.push(msg)
+			}
+		}
+	}
+}
+
+// Hands the broker's reply to the request waiting for it
+func (s *session) complete(msg *protocol.DefaultMessage) {
+	s.mu.Lock()
+	done, ok := s.pending[msg.Payload.Request]
+	delete(s.pending, msg.Payload.Request)
+	s.mu.Unlock()
+	if ok {
+		done(msg)
+	}
+}
+
+// Releases the requests still waiting for a reply once the connection is closed
+func (s *session) failPending() {
+	s.mu.Lock()
+	s.closed = true
+	pending := s.pending
+	s.pending = make(map[string]func(*protocol.DefaultMessage))
+	s.mu.Unlock()
+	for _, done := range pending {
+		done(nil)
+	}
+}
+
+// Routes the reply to the request waiting for it. Replies arriving after the request timed out are dropped.
+// Reports whether the message was a reply
+func (s *session) reply(msg *protocol.DefaultMessage) bool {
+	if !protocol.IsInbox(msg.Payload.Topic) {
+		return false
+	}
+	s.mu.Lock()
+	if replyCh, ok := s.inboxes[msg.Payload.Topic]; ok {
+		replyCh <- msg
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// Returns the stream the message from the topic is routed to. Stream of the topic itself takes precedence over the patterns it matches
+func (s *session) stream(topic string) *stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.streams[topic]; ok {
+		return st
+	}
+	for pattern, st := range s.streams {
+		if protocol.MatchTopic(pattern, topic) {
+			return st
+		}
+	}
+	return nil
+}
+
+func (s *session) closeStreams() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic, st := range s.streams {
+		st.close()
+		delete(s.streams, topic)
+	}
+}
+
+func (s *session) connect() error {
+	conn, err := dial(s.addr, s.protocol)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Payload of the registration. Carries the durable name if the client has one
+func (s *session) registration() *protocol.DefaultPayload {
+	if s.name == "" {
+		return nil
+	}
+	return &protocol.DefaultPayload{Name: s.name}
+}
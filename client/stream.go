@@ -0,0 +1,66 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/marcell7/MQ/protocol"
+)
+
+// Buffers messages pushed by the broker so that reading from the connection never waits for a slow consumer
+type stream struct {
+	mu     sync.Mutex                     // mutex for the queue
+	cond   *sync.Cond                     // signals that the queue changed
+	queue  []*protocol.DefaultMessage     // messages not yet handed to the consumer
+	closed bool                           // Set once the connection is closed
+	ch     chan *protocol.DefaultMessage  // Channel the consumer reads messages from
+	onTake func(*protocol.DefaultMessage) // Called every time the consumer takes a message. Can be nil
+}
+
+// Constructor for the stream struct
+func newStream(onTake func(*protocol.DefaultMessage)) *stream {
+	s := &stream{
+		ch:     make(chan *protocol.DefaultMessage),
+		onTake: onTake,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.start()
+	return s
+}
+
+// Queues the message for the consumer
+func (s *stream) push(msg *protocol.DefaultMessage) {
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// Closes the consumer's channel once the queued messages are handed over
+func (s *stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// Hands queued messages to the consumer in order
+func (s *stream) start() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		s.ch <- msg
+		if s.onTake != nil {
+			s.onTake(msg)
+		}
+	}
+}
@@ -1,138 +1,233 @@
 package client
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"io"
-	"net"
+	"time"
 
 	"github.com/marcell7/MQ/protocol"
 )
 
+// Returned by ReceiveWait when no message arrived before the wait timed out
+var ErrNoMessage = errors.New("no message arrived before the wait timed out")
+
 type Subscriber interface {
-	Subscribe(string) error                           // Subscribes to the user provided topic
-	Receive(string) (*protocol.DefaultMessage, error) // Receive the last message from the topic queue (FIFO style)
-	Close() error                                     // Closes the connection
-	start() error                                     // Starts listening for incoming messages
-	connect() error                                   // Connects the client to the broker (tcp server)
-	register() error                                  // Registers the client as a subscriber on the broker
+	Subscribe(string) error                                                    // Subscribes to the user provided topic, or to every topic matching the pattern (e.g. "orders.*")
+	SubscribeGroup(string, string) error                                       // Subscribes to the topic as a member of the consumer group. Each message is received by only one member
+	SubscribeWith(string, SubscribeOptions) error                              // Subscribes to the topic with the provided options
+	SubscribeWithStatus(string, SubscribeOptions) (bool, error)                // Subscribes to the topic and reports whether a new subscription was created
+	Unsubscribe(string) error                                                  // Unsubscribes from the topic (or pattern) discarding the messages queued for the subscription
+	UnsubscribeWith(string, UnsubscribeOptions) error                          // Unsubscribes from the topic with the provided options
+	Stream(string, SubscribeOptions) (<-chan *protocol.DefaultMessage, error)  // Subscribes to the topic and returns a channel the broker pushes messages to as they arrive
+	StreamFunc(string, SubscribeOptions, func(*protocol.DefaultMessage)) error // Subscribes to the topic and calls the handler for every message pushed by the broker
+	Credit(string, int) error                                                  // Allows the broker to push n more messages from the topic
+	Ack(*protocol.DefaultMessage) error                                        // Acknowledges that the received message was processed
+	Nack(*protocol.DefaultMessage) error                                       // Rejects the received message so that it is redelivered
+	NackWithReason(*protocol.DefaultMessage, string) error                     // Rejects the received message and records why it failed
+	Reply(*protocol.DefaultMessage, []byte) error                              // Sends the reply to the requester of the received message
+	Receive(string) (*protocol.DefaultMessage, error)                          // Receive the last message from the topic queue (FIFO style)
+	ReceiveWait(string, time.Duration) (*protocol.DefaultMessage, error)       // Receive the next message waiting up to the given duration for one to arrive
+	Seek(string, int64) error                                                  // Moves the cursor in the topic so that the next message received is the one at the offset
+	SeekToEarliest(string) error                                               // Moves the cursor to the first message kept in the topic
+	SeekToLatest(string) error                                                 // Moves the cursor past the last message in the topic
+	Close() error                                                              // Closes the connection
+	start() error                                                              // Starts listening for incoming messages
+	connect() error                                                            // Connects the client to the broker (tcp server)
+	register() error                                                           // Registers the client as a subscriber on the broker
 }
 
 // Implements Subscriber interface
 type DefaultSubscriber struct {
-	addr       string                        // Address of the broker
-	conn       net.Conn                      // Connection of that specific subscriber - allows for writing and receiving messages from / to the broker
-	protocol   protocol.Protocol             // Protocol instance for decoding messages
-	okCh       chan struct{}                 // Channel for signaling succesfully processed messages
-	errCh      chan *protocol.DefaultMessage // Channel for errors encountered on the broker
-	receiverCh chan *protocol.DefaultMessage // Channel used for receiving messages from the broker
+	*session
 }
 
 // Constructor for the DefaultSubscriber struct
-func NewSubscriber(addr string) (*DefaultSubscriber, error) {
-	ds := &DefaultSubscriber{
-		addr:       addr,
-		protocol:   new(protocol.DefaultProtocol),
-		okCh:       make(chan struct{}),
-		errCh:      make(chan *protocol.DefaultMessage),
-		receiverCh: make(chan *protocol.DefaultMessage),
-	}
-	if err := ds.connect(); err != nil {
+func NewSubscriber(addr string, opts ...Option) (*DefaultSubscriber, error) {
+	ds := &DefaultSubscriber{session: newSession(addr, opts)}
+	if err := ds.open(ds.register); err != nil {
 		return nil, err
 	}
+	return ds, nil
+}
 
-	go ds.start()
+// Settings of a subscription
+type SubscribeOptions struct {
+	Group      string        // Consumer group to join. Each message is received by only one member of the group
+	Ack        bool          // Received messages have to be acknowledged with Ack, otherwise they are redelivered
+	AckTimeout time.Duration // Time after which an unacknowledged message is redelivered. Broker's default is used if zero
+	Prefetch   int           // Maximum number of messages pushed by the broker that were not yet acknowledged (or taken from the stream if Ack is off). Unlimited if zero
+}
 
-	if err := ds.register(); err != nil {
+func (ds *DefaultSubscriber) Subscribe(topic string) error {
+	return ds.SubscribeWith(topic, SubscribeOptions{})
+}
+
+func (ds *DefaultSubscriber) SubscribeGroup(topic string, group string) error {
+	return ds.SubscribeWith(topic, SubscribeOptions{Group: group})
+}
+
+func (ds *DefaultSubscriber) SubscribeWith(topic string, opts SubscribeOptions) error {
+	_, err := ds.subscribe(topic, opts, false)
+	return err
+}
+
+// Returns false if the subscriber re-attached to an existing subscription (its own, a consumer group's
+// or one restored by the broker) and gets the messages already queued in it
+func (ds *DefaultSubscriber) SubscribeWithStatus(topic string, opts SubscribeOptions) (bool, error) {
+	return ds.subscribe(topic, opts, false)
+}
+
+// Settings of unsubscribing
+type UnsubscribeOptions struct {
+	Drain bool // Messages already queued for the subscription are still delivered before it is deleted. They are discarded otherwise
+}
+
+func (ds *DefaultSubscriber) Unsubscribe(topic string) error {
+	return ds.UnsubscribeWith(topic, UnsubscribeOptions{})
+}
+
+// Stream of the topic is closed unless the subscription is drained, in which case the remaining messages are still pushed to it
+func (ds *DefaultSubscriber) UnsubscribeWith(topic string, opts UnsubscribeOptions) error {
+	if err := ds.request(protocol.CMD_UNSUB, &protocol.DefaultPayload{Topic: topic, Drain: opts.Drain}); err != nil {
+		return err
+	}
+	if !opts.Drain {
+		ds.mu.Lock()
+		if s, ok := ds.streams[topic]; ok {
+			s.close()
+			delete(ds.streams, topic)
+		}
+		ds.mu.Unlock()
+	}
+	return nil
+}
+
+// Messages pushed to the channel are not received with Receive. The channel is closed when the connection is closed
+func (ds *DefaultSubscriber) Stream(topic string, opts SubscribeOptions) (<-chan *protocol.DefaultMessage, error) {
+	var onTake func(*protocol.DefaultMessage)
+	if opts.Prefetch > 0 && !opts.Ack {
+		// Without acknowledgements credits are given back once the consumer takes half of the window.
+		// Messages streamed from a pattern are credited back to the topics they came from
+		taken := make(map[string]int)
+		onTake = func(msg *protocol.DefaultMessage) {
+			taken[msg.Payload.Topic]++
+			if n := taken[msg.Payload.Topic]; n >= (opts.Prefetch+1)/2 {
+				if err := ds.Credit(msg.Payload.Topic, n); err != nil {
+					fmt.Printf("error granting credits: %s\n", err)
+				}
+				taken[msg.Payload.Topic] = 0
+			}
+		}
+	}
+	s := newStream(onTake)
+	ds.mu.Lock()
+	if previous, ok := ds.streams[topic]; ok {
+		previous.close()
+	}
+	ds.streams[topic] = s
+	ds.mu.Unlock()
+	if _, err := ds.subscribe(topic, opts, true); err != nil {
+		ds.mu.Lock()
+		delete(ds.streams, topic)
+		ds.mu.Unlock()
+		s.close()
 		return nil, err
 	}
-	return ds, nil
+	return s.ch, nil
 }
 
-func (ds *DefaultSubscriber) Subscribe(topic string) error {
-	payload := fmt.Sprintf(`{"topic":"%s"}`, topic)
-	if _, err := ds.conn.Write([]byte(fmt.Sprintf("SUB %s\n", payload))); err != nil {
+// Handler is called from a separate goroutine, one message at a time
+func (ds *DefaultSubscriber) StreamFunc(topic string, opts SubscribeOptions, handler func(*protocol.DefaultMessage)) error {
+	ch, err := ds.Stream(topic, opts)
+	if err != nil {
 		return err
 	}
-	select {
-	case <-ds.okCh:
-		// If subscribe message was processed succesfully
-		return nil
-	case errMsg := <-ds.errCh:
-		// If subscribe message was NOT processed succesfully (received error from the broker)
-		return errors.New(errMsg.Payload.Error)
+	go func() {
+		for msg := range ch {
+			handler(msg)
+		}
+	}()
+	return nil
+}
+
+// Broker does not reply to CREDIT, so this doesn't wait for the broker
+func (ds *DefaultSubscriber) Credit(topic string, n int) error {
+	return ds.send(protocol.CMD_CREDIT, &protocol.DefaultPayload{Topic: topic, Credits: n})
+}
+
+func (ds *DefaultSubscriber) subscribe(topic string, opts SubscribeOptions, stream bool) (bool, error) {
+	ok, err := ds.call(protocol.CMD_SUB, &protocol.DefaultPayload{
+		Topic:      topic,
+		Group:      opts.Group,
+		Ack:        opts.Ack,
+		AckTimeout: opts.AckTimeout.Milliseconds(),
+		Stream:     stream,
+		Prefetch:   opts.Prefetch,
+	})
+	if err != nil {
+		return false, err
 	}
+	return ok.Payload != nil && ok.Payload.Created, nil
 }
 
 func (ds *DefaultSubscriber) Receive(topic string) (*protocol.DefaultMessage, error) {
-	payload := fmt.Sprintf(`{"topic":"%s"}`, topic)
-	if _, err := ds.conn.Write([]byte(fmt.Sprintf("RECV %s\n", payload))); err != nil {
+	return ds.receive(&protocol.DefaultPayload{Topic: topic})
+}
+
+// Broker holds the request until a message arrives, so there is no need to poll. Returns ErrNoMessage if the wait times out
+func (ds *DefaultSubscriber) ReceiveWait(topic string, wait time.Duration) (*protocol.DefaultMessage, error) {
+	return ds.receive(&protocol.DefaultPayload{Topic: topic, Wait: wait.Milliseconds()})
+}
+
+func (ds *DefaultSubscriber) receive(payload *protocol.DefaultPayload) (*protocol.DefaultMessage, error) {
+	reply, err := ds.roundTrip(protocol.CMD_RECV, payload)
+	if err != nil {
 		return nil, err
 	}
-	select {
-	case msg := <-ds.receiverCh:
+	switch reply.Command {
+	case protocol.CMD_RESP:
 		// Received item/message from the topic queue
-		return msg, nil
-	case errMsg := <-ds.errCh:
+		return reply, nil
+	case protocol.CMD_EMPTY:
+		return nil, ErrNoMessage
+	default:
 		// Error received from the broker
-		return nil, errors.New(errMsg.Payload.Error)
+		return nil, replyError(reply)
 	}
 }
 
-func (ds *DefaultSubscriber) Close() error {
-	if err := ds.conn.Close(); err != nil {
-		return err
-	}
-	return nil
+func (ds *DefaultSubscriber) Ack(msg *protocol.DefaultMessage) error {
+	return ds.request(protocol.CMD_ACK, &protocol.DefaultPayload{Topic: msg.Payload.Topic, Offset: msg.Payload.Offset})
 }
 
-func (ds *DefaultSubscriber) start() error {
-	reader := bufio.NewReader(ds.conn)
-	for {
-		data, _, err := reader.ReadLine()
-		if err != nil {
-			if err == io.EOF {
-				return err
-			} else {
-				fmt.Printf("error: %s\n", err)
-				return err
-			}
-		}
-		msg := &protocol.DefaultMessage{}
-		if err := ds.protocol.Decode(msg, data); err != nil {
-			fmt.Println("Error decoding")
-			return err
-		}
-		switch msg.Command {
-		case protocol.CMD_OK:
-			ds.okCh <- struct{}{}
-		case protocol.CMD_ERROR:
-			ds.errCh <- msg
-		case protocol.CMD_RESP:
-			ds.receiverCh <- msg
-		}
+func (ds *DefaultSubscriber) Nack(msg *protocol.DefaultMessage) error {
+	return ds.NackWithReason(msg, "")
+}
 
-	}
+func (ds *DefaultSubscriber) NackWithReason(msg *protocol.DefaultMessage, reason string) error {
+	return ds.request(protocol.CMD_NACK, &protocol.DefaultPayload{Topic: msg.Payload.Topic, Offset: msg.Payload.Offset, Reason: reason})
 }
 
-func (ds *DefaultSubscriber) connect() error {
-	conn, err := net.Dial("tcp", ds.addr)
-	if err != nil {
-		return err
+// Message has to be published with Request (or carry a reply-to inbox or topic some other way)
+func (ds *DefaultSubscriber) Reply(msg *protocol.DefaultMessage, reply []byte) error {
+	if msg.Payload.ReplyTo == "" {
+		return errors.New("message has nowhere to send the reply to")
 	}
-	ds.conn = conn
-	return nil
+	return ds.request(protocol.CMD_REPLY, &protocol.DefaultPayload{Topic: msg.Payload.ReplyTo, Message: string(reply)})
+}
+
+func (ds *DefaultSubscriber) Seek(topic string, offset int64) error {
+	return ds.request(protocol.CMD_SEEK, &protocol.DefaultPayload{Topic: topic, Offset: offset})
+}
+
+func (ds *DefaultSubscriber) SeekToEarliest(topic string) error {
+	return ds.request(protocol.CMD_SEEK, &protocol.DefaultPayload{Topic: topic, Position: protocol.PositionEarliest})
+}
+
+func (ds *DefaultSubscriber) SeekToLatest(topic string) error {
+	return ds.request(protocol.CMD_SEEK, &protocol.DefaultPayload{Topic: topic, Position: protocol.PositionLatest})
 }
 
 func (ds *DefaultSubscriber) register() error {
-	if _, err := ds.conn.Write([]byte("SUBREG\n")); err != nil {
-		return err
-	}
-	select {
-	case <-ds.okCh:
-		return nil
-	case errMsg := <-ds.errCh:
-		return errors.New(errMsg.Payload.Error)
-	}
+	return ds.request(protocol.CMD_SUBREG, ds.registration())
 }
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sent by the client right after connecting to switch the connection to the binary protocol.
+// The first byte never starts a text command, which lets the broker tell the two protocols apart
+var BinaryPreamble = []byte{0x00, 'M', 'Q', 0x01}
+
+// Frames (and lines of the text protocol) larger than this are rejected instead of being buffered in memory
+const MaxFrameSize = 64 << 20
+
+const (
+	frameLengthSize = 4 // Every frame is prefixed with the length of the rest of the frame
+	frameHeaderSize = 6 // command (1 byte) | flags (1 byte) | length of the headers (4 bytes)
+)
+
+// Bits of the flags byte of a frame
+const (
+	FlagHeaders byte = 1 << iota // Frame carries headers (every payload field except the message)
+	FlagBody                     // Frame carries the raw message bytes
+)
+
+// Length-prefixed binary protocol. Each frame looks like:
+//
+//	| length (uint32) | command (byte) | flags (byte) | headers length (uint32) | headers | body |
+//
+// Headers hold the JSON encoded payload without the message, which is carried as raw bytes in the body.
+// Messages can therefore contain arbitrary bytes (including newlines) and are never escaped.
+type BinaryProtocol struct {
+}
+
+func (bp BinaryProtocol) ReadFrame(reader *bufio.Reader) ([]byte, error) {
+	var length [frameLengthSize]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum frame size", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (bp BinaryProtocol) Decode(msg *DefaultMessage, data []byte) error {
+	if len(data) < frameHeaderSize {
+		return errors.New("frame is too short")
+	}
+	command := Command(data[0])
+	if !command.Valid() {
+		return fmt.Errorf("invalid command %s", command)
+	}
+	flags := data[1]
+	headersLength := int(binary.BigEndian.Uint32(data[2:frameHeaderSize]))
+	if headersLength > len(data)-frameHeaderSize {
+		return errors.New("headers exceed the frame")
+	}
+	headers := data[frameHeaderSize : frameHeaderSize+headersLength]
+	body := data[frameHeaderSize+headersLength:]
+
+	payload := new(DefaultPayload)
+	if flags&FlagHeaders != 0 {
+		if err := payload.serialize(headers); err != nil {
+			return err
+		}
+	}
+	if flags&FlagBody != 0 {
+		payload.Message = string(body)
+	}
+	msg.Command = command
+	msg.Payload = payload
+	return nil
+}
+
+func (bp BinaryProtocol) Encode(msg *DefaultMessage) ([]byte, error) {
+	if !msg.Command.Valid() {
+		return nil, fmt.Errorf("invalid command %s", msg.Command)
+	}
+	var flags byte
+	var headers, body []byte
+	if msg.Payload != nil {
+		meta := *msg.Payload
+		meta.Message = ""
+		var buf bytes.Buffer
+		if err := encodePayload(&buf, &meta); err != nil {
+			return nil, err
+		}
+		flags |= FlagHeaders
+		headers = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		if msg.Payload.Message != "" {
+			flags |= FlagBody
+			body = []byte(msg.Payload.Message)
+		}
+	}
+	size := frameHeaderSize + len(headers) + len(body)
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum frame size", size)
+	}
+	frame := make([]byte, frameLengthSize+size)
+	binary.BigEndian.PutUint32(frame[0:frameLengthSize], uint32(size))
+	frame[frameLengthSize] = byte(msg.Command)
+	frame[frameLengthSize+1] = flags
+	binary.BigEndian.PutUint32(frame[frameLengthSize+2:frameLengthSize+frameHeaderSize], uint32(len(headers)))
+	copy(frame[frameLengthSize+frameHeaderSize:], headers)
+	copy(frame[frameLengthSize+frameHeaderSize+len(headers):], body)
+	return frame, nil
+}
@@ -1,5 +1,7 @@
 package protocol
 
+import "fmt"
+
 type Command int
 
 const (
@@ -11,4 +13,71 @@ const (
 	CMD_RESP
 	CMD_OK
 	CMD_ERROR
+	CMD_SEEK
+	CMD_ACK
+	CMD_NACK
+	CMD_REDRIVE
+	CMD_CREDIT
+	CMD_EMPTY
+	CMD_TOPIC_CREATE
+	CMD_TOPIC_DELETE
+	CMD_TOPIC_LIST
+	CMD_TOPIC_INFO
+	CMD_TOPICS
+	CMD_INBOX
+	CMD_REPLY
+	CMD_UNSUB
+	CMD_REG
 )
+
+// Names of the commands on the wire. Shared by encoding and decoding so the two never drift apart
+var commandNames = map[Command]string{
+	CMD_PUBREG:  "PUBREG",
+	CMD_SUBREG:  "SUBREG",
+	CMD_PUB:     "PUB",
+	CMD_SUB:     "SUB",
+	CMD_RECV:    "RECV",
+	CMD_RESP:    "RESP",
+	CMD_OK:      "OK",
+	CMD_ERROR:   "ERROR",
+	CMD_SEEK:    "SEEK",
+	CMD_ACK:     "ACK",
+	CMD_NACK:    "NACK",
+	CMD_REDRIVE: "REDRIVE",
+	CMD_CREDIT:  "CREDIT",
+	CMD_EMPTY:   "EMPTY",
+
+	CMD_TOPIC_CREATE: "TOPIC_CREATE",
+	CMD_TOPIC_DELETE: "TOPIC_DELETE",
+	CMD_TOPIC_LIST:   "TOPIC_LIST",
+	CMD_TOPIC_INFO:   "TOPIC_INFO",
+	CMD_TOPICS:       "TOPICS",
+
+	CMD_INBOX: "INBOX",
+	CMD_REPLY: "REPLY",
+	CMD_UNSUB: "UNSUB",
+	CMD_REG:   "REG",
+}
+
+func (c Command) String() string {
+	if name, ok := commandNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Command(%d)", int(c))
+}
+
+// Returns the command with the given name
+func ParseCommand(name string) (Command, error) {
+	for command, n := range commandNames {
+		if n == name {
+			return command, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid command %q", name)
+}
+
+// Reports whether the command is known to the protocol
+func (c Command) Valid() bool {
+	_, ok := commandNames[c]
+	return ok
+}
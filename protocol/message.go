@@ -16,11 +16,90 @@ type Payload interface {
 }
 
 type DefaultPayload struct {
-	Topic   string
-	Message string
-	Error   string
+	Topic      string            `json:"topic,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Request    string            `json:"request,omitempty"`    // Id of the request. Echoed in the broker's reply so that replies can be matched to the requests in flight (every command and its reply)
+	Headers    map[string]string `json:"headers,omitempty"`    // Metadata of the message (PUB, RESP)
+	Id         string            `json:"id,omitempty"`         // Id the broker assigned to the message (OK to PUB, RESP)
+	Offset     int64             `json:"offset,omitempty"`     // Offset of the item in the topic (RESP) or the offset to seek to (SEEK)
+	Timestamp  int64             `json:"timestamp,omitempty"`  // Time (unix milliseconds) the message was published (OK to PUB, RESP)
+	Sequence   int64             `json:"sequence,omitempty"`   // Number of the message among the messages published to the topic, starting at 1 (OK to PUB, RESP)
+	Position   string            `json:"position,omitempty"`   // Seek to the "earliest" or "latest" item instead of Offset (SEEK)
+	Name       string            `json:"name,omitempty"`       // Durable name of the subscriber. Its subscriptions survive disconnects and are re-attached when it registers again (SUBREG)
+	Group      string            `json:"group,omitempty"`      // Consumer group to join (SUB)
+	Ack        bool              `json:"ack,omitempty"`        // Delivered messages have to be acknowledged with ACK, otherwise they are redelivered (SUB)
+	AckTimeout int64             `json:"acktimeout,omitempty"` // Time in milliseconds after which an unacknowledged message is redelivered (SUB)
+	Created    bool              `json:"created,omitempty"`    // New subscription was created instead of re-attaching to an existing one (OK to SUB)
+	Drain      bool              `json:"drain,omitempty"`      // Messages already queued for the subscription are delivered before it is deleted instead of being discarded (UNSUB)
+	Stream     bool              `json:"stream,omitempty"`     // Messages are pushed to the subscriber as RESP as soon as they arrive (SUB)
+	Prefetch   int               `json:"prefetch,omitempty"`   // Maximum number of pushed messages not yet acknowledged (or credited back). Unlimited if zero (SUB)
+	Credits    int               `json:"credits,omitempty"`    // Number of additional messages the broker may push (CREDIT)
+	Wait       int64             `json:"wait,omitempty"`       // Time in milliseconds to wait for a message if there is none in the queue (RECV) or for the reply before the inbox is dropped (INBOX)
+	Reason     string            `json:"reason,omitempty"`     // Why the message was rejected (NACK)
+	Limit      int               `json:"limit,omitempty"`      // Maximum number of messages to move back from the dead-letter topic. All if zero (REDRIVE)
+	DeadLetter *DeadLetter       `json:"deadletter,omitempty"` // Why the message ended up in a dead-letter topic (RESP)
+	TTL        int64             `json:"ttl,omitempty"`        // Time in milliseconds after which the message is discarded if it was not delivered yet. Topic's TTL is used if zero (PUB)
+	DedupKey   string            `json:"dedupkey,omitempty"`   // Key identifying the message. Messages published to the topic again with the same key within the topic's dedup window are dropped (PUB)
+	Duplicate  bool              `json:"duplicate,omitempty"`  // Message was dropped as a duplicate. Id and the other fields describe the message published first (OK to PUB)
+	Delay      int64             `json:"delay,omitempty"`      // Time in milliseconds after which the message becomes visible to subscribers (PUB)
+	DeliverAt  int64             `json:"deliverat,omitempty"`  // Time (unix milliseconds) at which the message becomes visible to subscribers. Takes precedence over Delay (PUB)
+	Priority   int               `json:"priority,omitempty"`   // Messages with higher priority are delivered first in topics with priorities enabled (PUB, RESP)
+	Retain     bool              `json:"retain,omitempty"`     // Topic keeps the message and delivers it to every new subscription. Empty retained message clears it (PUB, RESP)
+	ReplyTo    string            `json:"replyto,omitempty"`    // Inbox (or topic) the reply to the message should be sent to (PUB, RESP)
+	Config     *TopicConfig      `json:"config,omitempty"`     // Settings of the topic (TOPIC_CREATE)
+	Topics     []TopicInfo       `json:"topics,omitempty"`     // State of the requested topics (TOPICS)
 }
 
+// Describes a message that was moved to a dead-letter topic
+type DeadLetter struct {
+	Topic    string `json:"topic,omitempty"`    // Topic the message was originally published to
+	Offset   int64  `json:"offset,omitempty"`   // Offset of the message in the original topic
+	Attempts int    `json:"attempts,omitempty"` // Number of times the message was delivered
+	Reason   string `json:"reason,omitempty"`   // Reason given by the subscriber when it last rejected the message
+}
+
+// Settings of a topic
+type TopicConfig struct {
+	MaxDeliveries   int    `json:"maxdeliveries,omitempty"`   // Number of deliveries after which an unacknowledged message is moved to the dead-letter topic. Unlimited if zero
+	DeadLetterTopic string `json:"deadlettertopic,omitempty"` // Topic that receives messages given up on. Messages are discarded if empty
+	MaxItems        int    `json:"maxitems,omitempty"`        // Maximum number of messages queued for a single subscription. Unlimited if zero
+	MaxBytes        int    `json:"maxbytes,omitempty"`        // Maximum total size of the messages queued for a single subscription. Unlimited if zero
+	Overflow        string `json:"overflow,omitempty"`        // What happens when a published message doesn't fit into a full queue - "reject" (default), "drop_oldest" or "drop_newest"
+	TTL             int64  `json:"ttl,omitempty"`             // Time in milliseconds after which messages that were not delivered yet are discarded. Never if zero
+	DedupWindow     int64  `json:"dedupwindow,omitempty"`     // Time in milliseconds a deduplication key is remembered for. Broker's default is used if zero
+	Priorities      bool   `json:"priorities,omitempty"`      // Messages with higher priority are delivered first. Priorities are ignored if false
+	RetentionItems  int    `json:"retentionitems,omitempty"`  // Maximum number of messages the topic keeps for seeking back. Broker's default is used if zero
+	RetentionAge    int64  `json:"retentionage,omitempty"`    // Time in milliseconds the topic keeps messages for seeking back. Forever if zero
+}
+
+const (
+	OverflowReject     = "reject"
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+)
+
+// State of a topic as reported by the broker
+type TopicInfo struct {
+	Name          string      `json:"name"`
+	Config        TopicConfig `json:"config"`
+	FirstOffset   int64       `json:"firstoffset"`   // Offset of the first message kept in the topic
+	NextOffset    int64       `json:"nextoffset"`    // Offset the next published message gets
+	Subscriptions int         `json:"subscriptions"` // Number of subscriptions. Consumer group counts as one
+	Subscribers   int         `json:"subscribers"`   // Number of connected subscribers
+	Queued        int         `json:"queued"`        // Number of messages waiting in the queues of all subscriptions
+	Inflight      int         `json:"inflight"`      // Number of delivered messages awaiting an acknowledgement
+	Dropped       int64       `json:"dropped"`       // Number of messages dropped from full queues
+	Expired       int64       `json:"expired"`       // Number of messages discarded because they expired before being delivered
+	Scheduled     int         `json:"scheduled"`     // Number of messages waiting for their delivery time
+	Retained      bool        `json:"retained"`      // Topic holds a retained message
+}
+
+const (
+	PositionEarliest = "earliest"
+	PositionLatest   = "latest"
+)
+
 func (dp *DefaultPayload) serialize(rawPayload []byte) error {
 	err := json.Unmarshal(rawPayload, dp)
 	if err != nil {
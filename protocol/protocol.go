@@ -1,49 +1,109 @@
 package protocol
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"encoding/json"
+	"fmt"
+	"io"
 )
 
 type Protocol interface {
-	Decode(*DefaultMessage, []byte) error // Decodes a raw tcp message into -> {Command:<CMD_?>, Payload:<*DefaultPayload>}
+	Decode(*DefaultMessage, []byte) error    // Decodes a raw tcp message into -> {Command:<CMD_?>, Payload:<*DefaultPayload>}
+	Encode(*DefaultMessage) ([]byte, error)  // Encodes the message into a raw tcp message ready to be written to the connection
+	ReadFrame(*bufio.Reader) ([]byte, error) // Reads a single raw tcp message from the connection
 }
 
+// Text protocol - every message is a single line: <COMMAND> <json payload>
 type DefaultProtocol struct {
 }
 
+// Picks the protocol the client on the other end of the connection speaks. Clients speaking the binary
+// protocol start the connection with BinaryPreamble, anything else is treated as the text protocol
+func Negotiate(reader *bufio.Reader) (Protocol, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != BinaryPreamble[0] {
+		return new(DefaultProtocol), nil
+	}
+	preamble := make([]byte, len(BinaryPreamble))
+	if _, err := io.ReadFull(reader, preamble); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(preamble, BinaryPreamble) {
+		return nil, fmt.Errorf("unsupported protocol preamble %x", preamble)
+	}
+	return new(BinaryProtocol), nil
+}
+
+// Returns the bytes the client has to send right after connecting for the broker to switch to the protocol
+func Preamble(p Protocol) []byte {
+	switch p.(type) {
+	case BinaryProtocol, *BinaryProtocol:
+		return BinaryPreamble
+	}
+	return nil
+}
+
+// Lines longer than MaxFrameSize are rejected before they are buffered whole
+func (dp DefaultProtocol) ReadFrame(reader *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(data)+len(chunk) > MaxFrameSize {
+			return nil, fmt.Errorf("line exceeds the maximum frame size of %d bytes", MaxFrameSize)
+		}
+		data = append(data, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+}
+
+// Payload is JSON encoded, so quotes, newlines and other special characters in it are escaped
+// and the encoded message always stays on a single line
+func (dp DefaultProtocol) Encode(msg *DefaultMessage) ([]byte, error) {
+	if !msg.Command.Valid() {
+		return nil, fmt.Errorf("invalid command %s", msg.Command)
+	}
+	buf := bytes.NewBufferString(msg.Command.String())
+	if msg.Payload != nil {
+		buf.WriteByte(' ')
+		if err := encodePayload(buf, msg.Payload); err != nil {
+			return nil, err
+		}
+	} else {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the JSON encoded payload followed by a newline
+func encodePayload(w io.Writer, payload *DefaultPayload) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(payload)
+}
+
 func (dp DefaultProtocol) Decode(msg *DefaultMessage, data []byte) error {
-	var command []byte
 	payload := new(DefaultPayload)
-	args := bytes.Split(bytes.TrimSpace(data), []byte(" "))
-	command = args[0]
-	if len(args) >= 2 {
-		pArgs := bytes.Join(args[1:], []byte(" "))
-		if err := payload.serialize(pArgs); err != nil {
+	name, rawPayload, _ := bytes.Cut(bytes.TrimSpace(data), []byte(" "))
+	command, err := ParseCommand(string(name))
+	if err != nil {
+		return err
+	}
+	if rawPayload = bytes.TrimSpace(rawPayload); len(rawPayload) > 0 {
+		if err := payload.serialize(rawPayload); err != nil {
 			return err
 		}
 	}
-	switch string(command) {
-	case "PUBREG":
-		msg.Command = CMD_PUBREG
-	case "SUBREG":
-		msg.Command = CMD_SUBREG
-	case "PUB":
-		msg.Command = CMD_PUB
-	case "SUB":
-		msg.Command = CMD_SUB
-	case "RECV":
-		msg.Command = CMD_RECV
-	case "RESP":
-		msg.Command = CMD_RESP
-	case "OK":
-		msg.Command = CMD_OK
-	case "ERROR":
-		msg.Command = CMD_ERROR
-	default:
-		return errors.New("invalid command")
-	}
+	msg.Command = command
 	msg.Payload = payload
 	return nil
-
 }
@@ -1,7 +1,11 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -32,3 +36,220 @@ func TestMessageSerializer(t *testing.T) {
 			dp.Topic, dp.Message)
 	}
 }
+
+func TestBinaryProtocolRoundTrip(t *testing.T) {
+	bp := new(BinaryProtocol)
+	sent := &DefaultMessage{
+		Command: CMD_RESP,
+		Payload: &DefaultPayload{
+			Topic:      "default",
+			Message:    "line one\nline \"two\"\x00\xff",
+			Offset:     42,
+			DeadLetter: &DeadLetter{Topic: "orders", Attempts: 3},
+		},
+	}
+	data, err := bp.Encode(sent)
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	frame, err := bp.ReadFrame(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Error reading the frame: %s", err)
+	}
+	received := &DefaultMessage{}
+	if err := bp.Decode(received, frame); err != nil {
+		t.Fatalf("Error decoding: %s", err)
+	}
+	if received.Command != sent.Command || received.Payload.Topic != "default" || received.Payload.Message != sent.Payload.Message ||
+		received.Payload.Offset != 42 || received.Payload.DeadLetter == nil || received.Payload.DeadLetter.Attempts != 3 {
+		t.Errorf("Expected %+v got %+v", sent.Payload, received.Payload)
+	}
+
+	// Commands without a payload
+	data, err = bp.Encode(&DefaultMessage{Command: CMD_OK})
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	frame, err = bp.ReadFrame(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Error reading the frame: %s", err)
+	}
+	if err := bp.Decode(received, frame); err != nil || received.Command != CMD_OK {
+		t.Errorf("Expected OK got %d (%v)", received.Command, err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader([]byte("SUBREG\n")))
+	p, err := Negotiate(reader)
+	if err != nil {
+		t.Fatalf("Error negotiating: %s", err)
+	}
+	if _, ok := p.(*DefaultProtocol); !ok {
+		t.Errorf("Expected the text protocol got %T", p)
+	}
+	// Nothing is consumed from a text connection
+	if frame, err := p.ReadFrame(reader); err != nil || string(frame) != "SUBREG" {
+		t.Errorf("Expected to read SUBREG got %q (%v)", frame, err)
+	}
+
+	data, _ := new(BinaryProtocol).Encode(&DefaultMessage{Command: CMD_SUBREG})
+	reader = bufio.NewReader(bytes.NewReader(append(append([]byte{}, BinaryPreamble...), data...)))
+	p, err = Negotiate(reader)
+	if err != nil {
+		t.Fatalf("Error negotiating: %s", err)
+	}
+	if _, ok := p.(*BinaryProtocol); !ok {
+		t.Errorf("Expected the binary protocol got %T", p)
+	}
+	frame, err := p.ReadFrame(reader)
+	if err != nil {
+		t.Fatalf("Error reading the frame: %s", err)
+	}
+	msg := &DefaultMessage{}
+	if err := p.Decode(msg, frame); err != nil || msg.Command != CMD_SUBREG {
+		t.Errorf("Expected SUBREG got %d (%v)", msg.Command, err)
+	}
+
+	if _, err := Negotiate(bufio.NewReader(bytes.NewReader([]byte{0x00, 'X', 'Y', 0x01}))); err == nil {
+		t.Errorf("Expected an error for an unknown preamble got none")
+	}
+}
+
+// Reader of a line that never ends
+type endlessLine struct{}
+
+func (endlessLine) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func TestTextFrameSize(t *testing.T) {
+	p := DefaultProtocol{}
+	// Lines longer than the reader's buffer are read whole
+	line := strings.Repeat("a", 10000)
+	if frame, err := p.ReadFrame(bufio.NewReader(strings.NewReader(line + "\r\n"))); err != nil || string(frame) != line {
+		t.Errorf("Expected to read the %d bytes long line got %d bytes (%v)", len(line), len(frame), err)
+	}
+	if _, err := p.ReadFrame(bufio.NewReader(endlessLine{})); err == nil {
+		t.Errorf("Expected an error for a line exceeding the maximum frame size got none")
+	}
+}
+
+func TestProtocolRoundTrip(t *testing.T) {
+	protocols := []Protocol{new(DefaultProtocol), new(BinaryProtocol)}
+	payloads := []*DefaultPayload{
+		nil,
+		{Topic: "default", Message: "Hello World", Headers: map[string]string{"content-type": "text/plain", "trace": "a\"b"}},
+		{Topic: "default", Message: `say "hi" \ <b>&</b>` + "\nnext line\t😀"},
+		{Topic: "orders.dlq", Request: "12", Id: "17f0c2d4a5b6c7d8", Offset: 7, Timestamp: 1700000000000, Sequence: 8, Position: PositionEarliest, Name: "billing", Group: "workers", Ack: true, AckTimeout: 500,
+			Stream: true, Prefetch: 10, Credits: 5, Wait: 1000, Reason: "bad \"input\"", Limit: 3,
+			DeadLetter: &DeadLetter{Topic: "orders", Offset: 6, Attempts: 5, Reason: "timeout"}, TTL: 60000, Delay: 1500, DeliverAt: 1700000001500, Priority: 7, Retain: true, DedupKey: "producer-1:42", Duplicate: true, ReplyTo: "_INBOX.17f0c2d4a5b6c7d9",
+			Config: &TopicConfig{MaxDeliveries: 5, DeadLetterTopic: "orders.dlq", MaxItems: 100, Overflow: OverflowDropOldest, TTL: 1000, DedupWindow: 60000, Priorities: true},
+			Topics: []TopicInfo{{Name: "orders", Config: TopicConfig{MaxBytes: 1024}, NextOffset: 8, Queued: 2, Dropped: 1, Scheduled: 3, Retained: true}}},
+		{Error: `topic "default" does not exist`},
+	}
+	for _, p := range protocols {
+		for command := range commandNames {
+			for _, payload := range payloads {
+				sent := &DefaultMessage{Command: command, Payload: payload}
+				data, err := p.Encode(sent)
+				if err != nil {
+					t.Fatalf("%T: error encoding %s: %s", p, command, err)
+				}
+				reader := bufio.NewReader(bytes.NewReader(data))
+				frame, err := p.ReadFrame(reader)
+				if err != nil {
+					t.Fatalf("%T: error reading %s: %s", p, command, err)
+				}
+				if reader.Buffered() != 0 {
+					t.Errorf("%T: %s was not read as a single frame", p, command)
+				}
+				received := &DefaultMessage{}
+				if err := p.Decode(received, frame); err != nil {
+					t.Fatalf("%T: error decoding %s (%q): %s", p, command, data, err)
+				}
+				if received.Command != command {
+					t.Errorf("%T: expected command %s got %s", p, command, received.Command)
+				}
+				expected := payload
+				if expected == nil {
+					expected = new(DefaultPayload)
+				}
+				if !reflect.DeepEqual(received.Payload, expected) {
+					t.Errorf("%T: %s payload changed in transit\nExpected: %+v\nGot: %+v", p, command, expected, received.Payload)
+				}
+			}
+		}
+	}
+}
+
+func TestCommandNames(t *testing.T) {
+	for command, name := range commandNames {
+		if command.String() != name {
+			t.Errorf("Expected %s got %s", name, command.String())
+		}
+		parsed, err := ParseCommand(name)
+		if err != nil || parsed != command {
+			t.Errorf("Expected %s to parse to %d got %d (%v)", name, command, parsed, err)
+		}
+	}
+	if _, err := ParseCommand("UNKNOWN"); err == nil {
+		t.Errorf("Expected an error parsing an unknown command got none")
+	}
+	if _, err := new(DefaultProtocol).Encode(&DefaultMessage{Command: Command(255)}); err == nil {
+		t.Errorf("Expected an error encoding an unknown command got none")
+	}
+}
+
+func TestProtocolEncodeEscapes(t *testing.T) {
+	data, err := new(DefaultProtocol).Encode(&DefaultMessage{
+		Command: CMD_RESP,
+		Payload: &DefaultPayload{Topic: "default", Message: "a \"quoted\"\nmessage"},
+	})
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	expected := `RESP {"topic":"default","message":"a \"quoted\"\nmessage"}` + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected %q got %q", expected, data)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.eu", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.deleted", false},
+		{"orders.>", "orders.eu", true},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+	}
+	for _, c := range cases {
+		if MatchTopic(c.pattern, c.topic) != c.match {
+			t.Errorf("Expected match of %s against %s to be %t", c.topic, c.pattern, c.match)
+		}
+	}
+	for _, invalid := range []string{"", "orders..eu", "orders.", "orders.>.eu"} {
+		if err := ValidateTopic(invalid, true); err == nil {
+			t.Errorf("Expected %q to be an invalid pattern", invalid)
+		}
+	}
+	if err := ValidateTopic("orders.*", false); err == nil {
+		t.Errorf("Expected wildcards to be invalid in a topic name")
+	}
+	if err := ValidateTopic("orders.*.created", true); err != nil {
+		t.Errorf("Expected orders.*.created to be a valid pattern got %s", err)
+	}
+}
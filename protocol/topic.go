@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	TopicSeparator = "." // Separates the levels of a hierarchical topic name - "orders.eu.created"
+	WildcardOne    = "*" // Matches exactly one level of a topic name - "orders.*.created"
+	WildcardMany   = ">" // Matches one or more levels at the end of a topic name - "orders.>"
+)
+
+// Names of reply inboxes start with InboxPrefix. Topics can't use it
+const InboxPrefix = "_INBOX."
+
+// Reports whether the name is the name of a reply inbox
+func IsInbox(name string) bool {
+	return strings.HasPrefix(name, InboxPrefix)
+}
+
+// Reports whether the topic name is a pattern containing wildcards
+func IsPattern(topic string) bool {
+	for _, level := range strings.Split(topic, TopicSeparator) {
+		if level == WildcardOne || level == WildcardMany {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the topic name has no empty levels. Wildcards are allowed only in patterns
+// and WildcardMany has to be the last level of the pattern
+func ValidateTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return errors.New("topic name must not be empty")
+	}
+	levels := strings.Split(topic, TopicSeparator)
+	for i, level := range levels {
+		switch level {
+		case "":
+			return fmt.Errorf("topic name %q has an empty level", topic)
+		case WildcardOne, WildcardMany:
+			if !pattern {
+				return fmt.Errorf("topic name %q must not contain wildcards", topic)
+			}
+			if level == WildcardMany && i != len(levels)-1 {
+				return fmt.Errorf("%s must be the last level of %q", WildcardMany, topic)
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether the topic matches the pattern. Pattern without wildcards matches only the topic with the same name
+func MatchTopic(pattern string, topic string) bool {
+	patternLevels := strings.Split(pattern, TopicSeparator)
+	topicLevels := strings.Split(topic, TopicSeparator)
+	for i, level := range patternLevels {
+		if level == WildcardMany {
+			return len(topicLevels) > i
+		}
+		if i >= len(topicLevels) || (level != WildcardOne && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}